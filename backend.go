@@ -2,49 +2,119 @@ package seabird_discord
 
 import (
 	"context"
+	"crypto/rand"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"maps"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/rs/zerolog"
 	"golang.org/x/sync/errgroup"
+	"golang.org/x/sync/singleflight"
 
 	seabird "github.com/seabird-chat/seabird-go"
 	"github.com/seabird-chat/seabird-go/pb"
 )
 
-type DiscordConfig struct {
-	Logger                zerolog.Logger
-	CommandPrefix         string
-	DiscordToken          string
-	SeabirdID             string
-	SeabirdHost           string
-	SeabirdToken          string
-	DiscordChannelMapping string
+// EventStats contains counters for events sent to seabird-core.
+type EventStats struct {
+	Dropped     uint64
+	Queued      uint64
+	Replayed    uint64
+	QueueLength int
+
+	// Unsupported counts Discord events which couldn't be sent because the
+	// ingest protocol has no way to represent them, such as deletions, or
+	// edits when ForwardEdits is off.
+	Unsupported uint64
+}
+
+// recentMessageCacheSize is how many events we remember the source message
+// of for replies.
+const recentMessageCacheSize = 1024
+
+// dmChannelCacheSize is how many DM channels we remember.
+const dmChannelCacheSize = 1024
+
+// messageContext is where a Discord message was sent. MessageID is empty for
+// slash commands.
+type messageContext struct {
+	GuildID   string
+	ChannelID string
+	MessageID string
 }
 
 type Backend struct {
 	id                    string
-	cmdPrefix             string
 	logger                zerolog.Logger
 	discord               *discordgo.Session
+	session               Session
 	grpc                  *seabird.ChatIngestClient
 	seabird               *seabird.Client
 	outputStream          chan *pb.ChatEvent
 	guildMentionCacheLock sync.Mutex
 	guildMentionCache     map[string]*strings.Replacer
 
-	channelMap   map[string]string
+	// webhooks contains the managed webhook for each channel which has sent a
+	// message through one. The lock only protects the maps - finding or
+	// creating a webhook goes through webhookLookups, so there's only one
+	// lookup for a channel at a time and other channels aren't blocked.
+	webhooksLock   sync.Mutex
+	webhooks       map[string]*discordgo.Webhook
+	webhookLookups singleflight.Group
+
+	// webhookOwners remembers whether webhooks we've seen messages from are
+	// ours. Our own webhooks stay in here after they're forgotten, as their
+	// messages may still arrive.
+	webhookOwners map[string]bool
+
+	// settings can be swapped at any time when the config is reloaded, so it
+	// should be loaded once and used for the rest of a handler.
+	settings           atomic.Pointer[runtimeSettings]
+	reloadConfig       func() (DiscordConfig, error)
+	configPath         string
+	configPollInterval time.Duration
+
 	userMapping  map[string]string
 	channelCount map[string]int
+
+	slashCommands     bool
+	slashCommandNames []string
+	interactions      *interactionTracker
+
+	// recentMessages maps IDs of events we've sent to the Discord message
+	// they came from, so replies can reference them.
+	recentMessages *lruCache[string, messageContext]
+
+	dispatcher *dispatcher
+	listening  *listenState
+	threads    *threadTracker
+
+	// dmChannels maps user IDs to the ID of their DM channel.
+	dmChannels *lruCache[string, string]
+
+	metrics      *metrics
+	health       *healthTracker
+	httpAddr     string
+	readyTimeout time.Duration
+
+	reconnect       *reconnectManager
+	queue           *eventQueue
+	ingestConnected atomic.Bool
+	droppedEvents   atomic.Uint64
+	reportedDrops   atomic.Uint64
+	queuedEvents    atomic.Uint64
+	replayedEvents  atomic.Uint64
+
+	unsupportedEvents atomic.Uint64
 }
 
 func New(config DiscordConfig) (*Backend, error) {
-	var err error
-
 	ciClient, err := seabird.NewChatIngestClient(config.SeabirdHost, config.SeabirdToken)
 	if err != nil {
 		return nil, fmt.Errorf("failed to create new chat ingest client: %w", err)
@@ -55,28 +125,70 @@ func New(config DiscordConfig) (*Backend, error) {
 		return nil, fmt.Errorf("failed to create new client: %w", err)
 	}
 
+	b, err := newBackend(config)
+	if err != nil {
+		return nil, err
+	}
+
+	b.grpc = ciClient
+	b.seabird = sbClient
+
+	return b, nil
+}
+
+// newBackend sets up everything other than the connection to seabird-core, so
+// the Discord side can be tested on its own.
+func newBackend(config DiscordConfig) (*Backend, error) {
+	var err error
+
 	b := &Backend{
-		id:                config.SeabirdID,
-		logger:            config.Logger,
-		cmdPrefix:         config.CommandPrefix,
-		grpc:              ciClient,
-		seabird:           sbClient,
-		outputStream:      make(chan *pb.ChatEvent, 10),
-		guildMentionCache: make(map[string]*strings.Replacer),
-		channelMap:        make(map[string]string),
-		userMapping:       make(map[string]string),
-		channelCount:      make(map[string]int),
-	}
-
-	// Convert the channel mapping into a useful format
-	if config.DiscordChannelMapping != "" {
-		for _, item := range strings.Split(config.DiscordChannelMapping, ",") {
-			split := strings.SplitN(item, ":", 2)
-			if len(split) != 2 {
-				return nil, errors.New("invalid channel mapping")
-			}
+		id:                 config.SeabirdID,
+		logger:             config.Logger,
+		outputStream:       make(chan *pb.ChatEvent, 10),
+		guildMentionCache:  make(map[string]*strings.Replacer),
+		webhooks:           make(map[string]*discordgo.Webhook),
+		webhookOwners:      make(map[string]bool),
+		reloadConfig:       config.ReloadConfig,
+		configPath:         config.ConfigPath,
+		configPollInterval: config.ConfigPollInterval,
+		httpAddr:           config.HTTPAddr,
+		readyTimeout:       config.ReadyTimeout,
+		health:             newHealthTracker(),
+		userMapping:        make(map[string]string),
+		channelCount:       make(map[string]int),
+		reconnect:          newReconnectManager(config.ReconnectBackoff),
+		slashCommands:      config.SlashCommands,
+		slashCommandNames:  config.SlashCommandNames,
+		interactions:       newInteractionTracker(),
+		threads:            newThreadTracker(),
+		recentMessages:     newLRUCache[string, messageContext](recentMessageCacheSize),
+		dmChannels:         newLRUCache[string, string](dmChannelCacheSize),
+	}
 
-			b.channelMap[split[0]] = split[1]
+	b.metrics = newMetrics(b)
+
+	b.reconnect.OnStateChange(func(prev, next ConnState) {
+		b.ingestConnected.Store(next == ConnStateConnected)
+		if prev == ConnStateBackoff && next == ConnStateConnecting {
+			b.metrics.reconnects.Inc()
+		}
+		b.health.ingestStateChanged(prev, next)
+		b.logger.Debug().Stringer("from", prev).Stringer("to", next).Msg("ingest state changed")
+	})
+
+	b.settings.Store(newRuntimeSettings(config))
+
+	b.dispatcher = newDispatcher(config.RateLimit, config.SendWorkers, b.deliverMessage, b.messageResult)
+
+	b.listening, err = newListenState(config.ChannelStatePath)
+	if err != nil {
+		return nil, err
+	}
+
+	if config.EventQueuePath != "" {
+		b.queue, err = newEventQueue(config.EventQueuePath, config.EventQueueMaxSize, config.EventQueueMaxAge)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load event queue: %w", err)
 		}
 	}
 
@@ -85,6 +197,12 @@ func New(config DiscordConfig) (*Backend, error) {
 		return nil, fmt.Errorf("failed to create discord client: %w", err)
 	}
 
+	b.instrumentREST(b.discord.Client)
+
+	// The concrete session is only used to manage the gateway connection.
+	// Everything else goes through the Session interface.
+	b.session = discordSession{b.discord}
+
 	// Ideally we wouldn't need any additional intents, but in order to see all
 	// users for the mention cache, we need to have the GuildMembers and
 	// GuildPresences intents. The first makes it so we can see users, the
@@ -94,10 +212,24 @@ func New(config DiscordConfig) (*Backend, error) {
 			discordgo.IntentsGuildMembers |
 			discordgo.IntentsGuildPresences)
 
+	b.discord.AddHandler(b.handleConnect)
+	b.discord.AddHandler(b.handleDisconnect)
+	b.discord.AddHandler(b.handleReady)
 	b.discord.AddHandler(b.handleMessageCreate)
+	b.discord.AddHandler(b.handleMessageUpdate)
+	b.discord.AddHandler(b.handleMessageDelete)
+	b.discord.AddHandler(b.handleMessageReactionAdd)
+	b.discord.AddHandler(b.handleMessageReactionRemove)
+	b.discord.AddHandler(b.handleInteractionCreate)
 	b.discord.AddHandler(b.handleGuildCreate)
 	b.discord.AddHandler(b.handleGuildDelete)
-	//b.discord.AddHandler(b.handleChannelEdit)
+	b.discord.AddHandler(b.handleChannelCreate)
+	b.discord.AddHandler(b.handleChannelUpdate)
+	b.discord.AddHandler(b.handleChannelDelete)
+	b.discord.AddHandler(b.handleThreadCreate)
+	b.discord.AddHandler(b.handleThreadUpdate)
+	b.discord.AddHandler(b.handleThreadDelete)
+	b.discord.AddHandler(b.handleThreadListSync)
 	b.discord.AddHandler(b.handleVoiceStateUpdate)
 	b.discord.AddHandler(b.handleDiscordLog)
 
@@ -114,6 +246,10 @@ func (b *Backend) markGuildMentionCacheStale(guildId string) {
 	defer b.guildMentionCacheLock.Unlock()
 
 	delete(b.guildMentionCache, guildId)
+
+	// The global replacer is built from every guild, so it needs to be rebuilt
+	// as well.
+	delete(b.guildMentionCache, "")
 }
 
 func (b *Backend) handleGuildMemberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
@@ -132,20 +268,42 @@ func (b *Backend) handleGuildMembersChunk(s *discordgo.Session, m *discordgo.Gui
 	b.markGuildMentionCacheStale(m.GuildID)
 }
 
+// getReplacer returns a replacer which converts @username mentions in
+// outgoing messages to Discord mentions. If guildId is empty, as it is for
+// DMs, members from all guilds are used.
 func (b *Backend) getReplacer(guildId string) *strings.Replacer {
 	b.guildMentionCacheLock.Lock()
 	defer b.guildMentionCacheLock.Unlock()
 
 	if _, ok := b.guildMentionCache[guildId]; !ok {
-		var candidates []string
-		g, err := b.discord.State.Guild(guildId)
-		if err != nil {
-			return strings.NewReplacer()
+		var guilds []*discordgo.Guild
+		if guildId == "" {
+			b.session.State().RLock()
+			guilds = append(guilds, b.session.State().Guilds...)
+			b.session.State().RUnlock()
+		} else {
+			g, err := b.session.State().Guild(guildId)
+			if err != nil {
+				return strings.NewReplacer()
+			}
+			guilds = []*discordgo.Guild{g}
 		}
 
-		for _, m := range g.Members {
-			candidates = append(candidates, "@"+m.User.Username, m.User.Mention())
+		var candidates []string
+		seen := make(map[string]bool)
+
+		b.session.State().RLock()
+		for _, g := range guilds {
+			for _, m := range g.Members {
+				if seen[m.User.ID] {
+					continue
+				}
+				seen[m.User.ID] = true
+
+				candidates = append(candidates, "@"+m.User.Username, m.User.Mention())
+			}
 		}
+		b.session.State().RUnlock()
 
 		b.guildMentionCache[guildId] = strings.NewReplacer(candidates...)
 	}
@@ -153,50 +311,126 @@ func (b *Backend) getReplacer(guildId string) *strings.Replacer {
 	return b.guildMentionCache[guildId]
 }
 
+// renderMessage converts an outgoing message to the text which should be sent
+// to Discord. If a root block is provided, it is preferred over the plain text,
+// as it preserves formatting.
+func (b *Backend) renderMessage(channelID string, text string, rootBlock *pb.Block) string {
+	c, err := b.session.State().Channel(channelID)
+	if err != nil {
+		b.logger.Warn().Err(err).Msg("Tried to send message to unknown channel")
+		return renderWithReplacer(strings.NewReplacer(), text, rootBlock)
+	}
+
+	return renderWithReplacer(b.getReplacer(c.GuildID), text, rootBlock)
+}
+
+// renderPrivateMessage is similar to renderMessage, but as DMs aren't
+// associated with a guild, mentions of anyone the bot can see are replaced.
+func (b *Backend) renderPrivateMessage(text string, rootBlock *pb.Block) string {
+	return renderWithReplacer(b.getReplacer(""), text, rootBlock)
+}
+
+func renderWithReplacer(replacer *strings.Replacer, text string, rootBlock *pb.Block) string {
+	if rootBlock != nil {
+		return newBlockRenderer(replacer).render(rootBlock)
+	}
+
+	return replacer.Replace(text)
+}
+
+// dmChannel returns the ID of the DM channel for a user, creating it if
+// needed.
+func (b *Backend) dmChannel(userID string) (string, error) {
+	if channelID, ok := b.dmChannels.Get(userID); ok {
+		return channelID, nil
+	}
+
+	c, err := b.session.UserChannelCreate(userID)
+	if err != nil {
+		return "", fmt.Errorf("failed to open DM channel: %w", err)
+	}
+
+	b.dmChannels.Add(userID, c.ID)
+
+	return c.ID, nil
+}
+
 func (b *Backend) handleGuildCreate(s *discordgo.Session, m *discordgo.GuildCreate) {
+	b.markGuildMentionCacheStale(m.ID)
+
 	for _, channel := range m.Channels {
-		if channel.Type != discordgo.ChannelTypeGuildText {
-			continue
-		}
+		b.writeJoinChannel(channel)
+	}
 
-		b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_JoinChannel{JoinChannel: &pb.JoinChannelChatEvent{
-			ChannelId:   channel.ID,
-			DisplayName: channel.Name,
-			Topic:       channel.Topic,
-		}}})
+	for _, thread := range m.Threads {
+		b.writeJoinChannel(thread)
 	}
 }
 
 func (b *Backend) handleGuildDelete(s *discordgo.Session, m *discordgo.GuildDelete) {
+	b.markGuildMentionCacheStale(m.ID)
+
 	for _, channel := range m.Channels {
-		if channel.Type != discordgo.ChannelTypeGuildText {
+		if !isMessageChannel(channel) {
 			continue
 		}
 
-		b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_LeaveChannel{LeaveChannel: &pb.LeaveChannelChatEvent{
-			ChannelId: channel.ID,
-		}}})
+		b.writeLeaveChannel(channel.ID)
+	}
+
+	threads := b.threads.matching(func(info threadInfo) bool {
+		return info.guildID == m.ID
+	})
+	for _, threadID := range threads {
+		b.writeLeaveChannel(threadID)
 	}
 }
 
-func (b *Backend) handleChannelEdit(s *discordgo.Session, m *discordgo.ChannelUpdate) {
-	fmt.Printf("%+v\n", m)
+func (b *Backend) handleChannelCreate(s *discordgo.Session, m *discordgo.ChannelCreate) {
+	b.writeJoinChannel(m.Channel)
+}
 
-	/*
-		b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_ChangeChannel{ChangeChannel: &pb.ChangeChannelChatEvent{
-			ChannelId: m.ID,
-		}}})
-	*/
+func (b *Backend) handleChannelUpdate(s *discordgo.Session, m *discordgo.ChannelUpdate) {
+	if !isMessageChannel(m.Channel) || !b.listening.IsListening(m.ID) {
+		return
+	}
+
+	b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_ChangeChannel{ChangeChannel: &pb.ChangeChannelChatEvent{
+		ChannelId:   m.ID,
+		DisplayName: b.channelDisplayName(m.Channel),
+		Topic:       m.Topic,
+	}}})
+}
+
+func (b *Backend) handleChannelDelete(s *discordgo.Session, m *discordgo.ChannelDelete) {
+	if !isMessageChannel(m.Channel) {
+		return
+	}
+
+	if b.listening.IsListening(m.ID) {
+		b.writeLeaveChannel(m.ID)
+		return
+	}
+
+	// The channel is gone, so there's no reason to remember it was muted.
+	_, err := b.listening.SetListening(m.ID, true)
+	if err != nil {
+		b.logger.Warn().Err(err).Msg("failed to update channel state")
+	}
 }
 
 func (b *Backend) handleMessageCreate(s *discordgo.Session, m *discordgo.MessageCreate) {
-	// Ignore all messages created by the bot itself. This is a requirement from
-	// the chat ingest API.
-	if m.Author.ID == s.State.User.ID {
+	// Ignore all messages created by the bot itself, including those sent
+	// through our webhooks. This is a requirement from the chat ingest API.
+	if m.Author.ID == b.session.BotUserID() || b.isOwnWebhook(m.WebhookID) {
 		return
 	}
 
-	b.handleMessageCreateImpl(s, m)
+	if !b.listening.IsListening(m.ChannelID) {
+		return
+	}
+
+	b.handleMessage(m.Message, false)
 
 	// All attachments count as regular message events
 	source := &pb.ChannelSource{
@@ -208,26 +442,90 @@ func (b *Backend) handleMessageCreate(s *discordgo.Session, m *discordgo.Message
 	}
 
 	for _, a := range m.Attachments {
-		b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_Message{Message: &pb.MessageEvent{
-			Source: source,
-			Text:   fmt.Sprintf("%s: %s", a.Filename, a.URL),
-		}}})
+		b.writeEvent(&pb.ChatEvent{
+			Inner: &pb.ChatEvent_Message{Message: &pb.MessageEvent{
+				Source: source,
+				Text:   fmt.Sprintf("%s: %s", a.Filename, a.URL),
+			}},
+			Tags: map[string]string{TagMessageID: m.ID},
+		})
+	}
+}
+
+func (b *Backend) handleMessageUpdate(s *discordgo.Session, m *discordgo.MessageUpdate) {
+	// Discord also sends updates when embeds are added to a message, but those
+	// don't have an edited timestamp or any of the original content.
+	if m.Author == nil || m.EditedTimestamp == nil {
+		return
+	}
+
+	if m.Author.ID == b.session.BotUserID() || b.isOwnWebhook(m.WebhookID) || !b.listening.IsListening(m.ChannelID) {
+		return
+	}
+
+	if !b.settings.Load().forwardEdits {
+		b.unsupportedEvents.Add(1)
+		b.logger.Debug().
+			Str("channel_id", m.ChannelID).
+			Str("message_id", m.ID).
+			Msg("Skipping message edit because forwarding edits is disabled")
+		return
 	}
+
+	b.handleMessage(m.Message, true)
 }
 
-func (b *Backend) handleMessageCreateImpl(s *discordgo.Session, m *discordgo.MessageCreate) {
-	fromDM, err := ComesFromDM(s, m)
+func (b *Backend) handleMessageDelete(s *discordgo.Session, m *discordgo.MessageDelete) {
+	// There's no way to represent a deleted message in the ingest protocol, so
+	// the best we can do is keep track of them.
+	b.unsupportedEvents.Add(1)
+	b.logger.Debug().
+		Str("channel_id", m.ChannelID).
+		Str("message_id", m.ID).
+		Msg("Skipping message deletion which can't be sent to seabird")
+}
+
+// handleMessage converts a Discord message to a seabird event. Edited messages
+// are only sent as channel messages or actions and are tagged with TagEdited.
+// Commands, mentions and private messages usually make a plugin do something,
+// so edits of them are dropped rather than running it a second time.
+func (b *Backend) handleMessage(m *discordgo.Message, edited bool) {
+	fromDM, err := ComesFromDM(b.session, &discordgo.MessageCreate{Message: m})
 	if err != nil {
 		b.logger.Warn().Err(err).Msg("failed to determine if message is private")
 		return
 	}
 
-	rawText := ReplaceMentions(b.logger, s, m.Message)
+	if edited && fromDM {
+		return
+	}
+
+	rawText := ReplaceMentions(b.logger, b.session, m)
 	if rawText == "" {
 		return
 	}
 
+	tags := map[string]string{TagMessageID: m.ID}
+	if edited {
+		tags[TagEdited] = "true"
+	}
+
+	writeEvent := func(e *pb.ChatEvent) {
+		e.Id = newEventID()
+		e.Tags = tags
+		b.recentMessages.Add(e.Id, messageContext{
+			GuildID:   m.GuildID,
+			ChannelID: m.ChannelID,
+			MessageID: m.ID,
+		})
+		b.writeEvent(e)
+	}
+
 	if fromDM {
+		// We already know the DM channel for this user, so we can skip looking
+		// it up when sending a reply.
+		b.dmChannels.Add(m.Author.ID, m.ChannelID)
+
 		rootBlock, isAction, err := TextToBlock(rawText)
 		if err != nil {
 			b.logger.Warn().Err(err).Msg("failed to convert message to blocks")
@@ -235,17 +533,17 @@ func (b *Backend) handleMessageCreateImpl(s *discordgo.Session, m *discordgo.Mes
 		}
 
 		if isAction {
-			b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_PrivateAction{PrivateAction: &pb.PrivateActionEvent{
+			writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_PrivateAction{PrivateAction: &pb.PrivateActionEvent{
 				Source: &pb.User{
-					Id:          m.ChannelID,
+					Id:          m.Author.ID,
 					DisplayName: m.Author.Username,
 				},
 				RootBlock: rootBlock,
 			}}})
 		} else {
-			b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_PrivateMessage{PrivateMessage: &pb.PrivateMessageEvent{
+			writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_PrivateMessage{PrivateMessage: &pb.PrivateMessageEvent{
 				Source: &pb.User{
-					Id:          m.ChannelID,
+					Id:          m.Author.ID,
 					DisplayName: m.Author.Username,
 				},
 				RootBlock: rootBlock,
@@ -262,39 +560,52 @@ func (b *Backend) handleMessageCreateImpl(s *discordgo.Session, m *discordgo.Mes
 		},
 	}
 
-	// Special case - if the message started with the command prefix, we do much
-	// less parsing and processing on it.
-	if strings.HasPrefix(rawText, b.cmdPrefix) {
-		msgParts := strings.SplitN(rawText, " ", 2)
-		if len(msgParts) < 2 {
-			msgParts = append(msgParts, "")
-		}
-
-		command := strings.TrimPrefix(msgParts[0], b.cmdPrefix)
-		arg := msgParts[1]
-
-		b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_Command{Command: &pb.CommandEvent{
+	writeCommand := func(command, arg string) {
+		writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_Command{Command: &pb.CommandEvent{
 			Source:  source,
 			Command: command,
 			Arg:     arg,
 		}}})
+	}
+
+	settings := b.settings.Load()
+
+	// Special case - if the message started with a command prefix, we do much
+	// less parsing and processing on it. Anything which only looks like a
+	// command, such as "!!!", is treated as a normal message.
+	if command, arg, ok := ParseCommand(rawText, settings.commandPrefixes(m.GuildID, m.ChannelID)); ok {
+		if !edited {
+			writeCommand(command, arg)
+		}
 		return
 	}
 
 	// Special case - if the original message started with the bot's user ID,
 	// make sure we trim that off before processing as a mention event.
-	mentionPrefix := fmt.Sprintf("<@%s>", s.State.User.ID)
-	if strings.HasPrefix(m.Content, mentionPrefix) {
-		msg := *m.Message
-		msg.Content = strings.TrimSpace(strings.TrimPrefix(m.Content, mentionPrefix))
+	if content, ok := trimBotMention(m.Content, b.session.BotUserID()); ok {
+		if edited {
+			return
+		}
 
-		rootBlock, _, err := TextToBlock(ReplaceMentions(b.logger, s, &msg))
+		msg := *m
+		msg.Content = content
+
+		// If mention commands are enabled, anything after the mention is
+		// treated the same as if it followed a command prefix.
+		if settings.mentionCommands {
+			if command, arg, ok := parseCommandBody(ReplaceMentions(b.logger, b.session, &msg)); ok {
+				writeCommand(command, arg)
+				return
+			}
+		}
+
+		rootBlock, _, err := TextToBlock(ReplaceMentions(b.logger, b.session, &msg))
 		if err != nil {
 			b.logger.Warn().Err(err).Msg("failed to convert message to blocks")
 			return
 		}
 
-		b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_Mention{Mention: &pb.MentionEvent{
+		writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_Mention{Mention: &pb.MentionEvent{
 			Source:    source,
 			RootBlock: rootBlock,
 		}}})
@@ -308,24 +619,24 @@ func (b *Backend) handleMessageCreateImpl(s *discordgo.Session, m *discordgo.Mes
 	}
 
 	if isAction {
-		b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_Action{Action: &pb.ActionEvent{
+		writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_Action{Action: &pb.ActionEvent{
 			Source:    source,
 			RootBlock: rootBlock,
 		}}})
 	} else {
-		b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_Message{Message: &pb.MessageEvent{
+		writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_Message{Message: &pb.MessageEvent{
 			Source:    source,
 			RootBlock: rootBlock,
 		}}})
 	}
 }
 
-func (b *Backend) sendJoinNotification(s *discordgo.Session, guildID, userID, channelID string, count int) {
+func (b *Backend) sendJoinNotification(guildID, userID, channelID string, count int) {
 	if count != 1 {
 		return
 	}
 
-	userInfo, err := s.State.Member(guildID, userID)
+	userInfo, err := b.session.State().Member(guildID, userID)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -339,7 +650,7 @@ func (b *Backend) sendJoinNotification(s *discordgo.Session, guildID, userID, ch
 		}
 	}
 
-	channelInfo, err := s.State.Channel(channelID)
+	channelInfo, err := b.session.State().Channel(channelID)
 	if err != nil {
 		fmt.Println(err)
 		return
@@ -349,7 +660,7 @@ func (b *Backend) sendJoinNotification(s *discordgo.Session, guildID, userID, ch
 	defer cancel()
 
 	_, err = b.seabird.Inner.SendMessage(ctx, &pb.SendMessageRequest{
-		ChannelId: b.channelMap[channelID],
+		ChannelId: b.settings.Load().channelMap[channelID],
 		Text:      fmt.Sprintf("%s has joined voice channel %s", userName, channelInfo.Mention()),
 	})
 	if err != nil {
@@ -370,7 +681,9 @@ func (b *Backend) handleVoiceStateUpdate(s *discordgo.Session, m *discordgo.Voic
 
 	// If the user changed channels
 	if prevChannel != targetChannel {
-		if prevChannel != "" {
+		// The channel map may have changed since the user joined, so we
+		// only decrement channels which are being counted.
+		if _, ok := b.channelCount[prevChannel]; ok {
 			b.channelCount[prevChannel] -= 1
 
 			if b.channelCount[prevChannel] == 0 {
@@ -378,10 +691,10 @@ func (b *Backend) handleVoiceStateUpdate(s *discordgo.Session, m *discordgo.Voic
 			}
 		}
 
-		if targetChannel != "" && b.channelMap[targetChannel] != "" {
+		if targetChannel != "" && b.settings.Load().channelMap[targetChannel] != "" {
 			b.channelCount[targetChannel] += 1
 
-			b.sendJoinNotification(s, m.GuildID, m.UserID, targetChannel, b.channelCount[targetChannel])
+			b.sendJoinNotification(m.GuildID, m.UserID, targetChannel, b.channelCount[targetChannel])
 		}
 	}
 }
@@ -408,15 +721,265 @@ func (b *Backend) writeFailure(id string, reason string) {
 	})
 }
 
+// deliverMessage sends a message from the dispatcher.
+func (b *Backend) deliverMessage(msg *outboundMessage) error {
+	channelID := msg.ChannelID
+	if msg.UserID != "" {
+		var err error
+		channelID, err = b.dmChannel(msg.UserID)
+		if err != nil {
+			return err
+		}
+	}
+
+	return b.sendMessage(channelID, msg.UserID != "", msg.Text, msg.Action, msg.Tags)
+}
+
+// messageResult lets seabird know if a message was sent.
+func (b *Backend) messageResult(msg *outboundMessage, err error) {
+	for _, id := range msg.RequestIDs {
+		b.observeOutboundRequest(msg.Type, msg.ChannelID, err)
+
+		if id == "" {
+			continue
+		}
+
+		if err != nil {
+			b.writeFailure(id, err.Error())
+		} else {
+			b.writeSuccess(id)
+		}
+	}
+}
+
+// sendMessage sends rendered text to a channel, splitting it into multiple
+// messages if it's too long. Actions are wrapped in italics. It stops at the
+// first message which fails to send. Private messages are always sent as the
+// bot user.
+func (b *Backend) sendMessage(channelID string, private bool, text string, action bool, tags map[string]string) error {
+	// Messages which don't reply to anything are used to answer a slash
+	// command in the channel which is still waiting, as long as they're not
+	// being sent as someone else.
+	if !private && tags[TagReplyTo] == "" && tags[TagUsername] == "" {
+		if eventID, ok := b.interactions.claim(channelID); ok {
+			tags = maps.Clone(tags)
+			if tags == nil {
+				tags = make(map[string]string)
+			}
+			tags[TagReplyTo] = eventID
+		}
+	}
+
+	for i, chunk := range messageChunks(text, action) {
+		// Only the first message should be sent as a reply, but the rest
+		// still need to keep the same identity. Responses to slash commands
+		// keep the tag so the rest are sent as follow-ups.
+		if i == 1 && tags[TagReplyTo] != "" && !b.interactions.has(tags[TagReplyTo]) {
+			tags = maps.Clone(tags)
+			delete(tags, TagReplyTo)
+		}
+
+		err := b.sendChannelMessage(channelID, private, chunk, tags)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// newEventID returns a random ID for an event which isn't a response to a
+// request.
+func newEventID() string {
+	buf := make([]byte, 16)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// messageReference returns a reference to the message an event came from, if
+// it was in the given channel.
+func (b *Backend) messageReference(channelID string, tags map[string]string) *discordgo.MessageReference {
+	eventID := tags[TagReplyTo]
+	if eventID == "" {
+		return nil
+	}
+
+	msg, ok := b.recentMessages.Get(eventID)
+	if !ok || msg.ChannelID != channelID {
+		b.logger.Debug().Str("event_id", eventID).Msg("Unknown reply target, sending as a normal message")
+		return nil
+	}
+
+	// Slash commands don't have a message to reply to.
+	if msg.MessageID == "" {
+		return nil
+	}
+
+	failIfNotExists := false
+	return &discordgo.MessageReference{
+		GuildID:         msg.GuildID,
+		ChannelID:       msg.ChannelID,
+		MessageID:       msg.MessageID,
+		FailIfNotExists: &failIfNotExists,
+	}
+}
+
 func (b *Backend) writeEvent(e *pb.ChatEvent) {
+	b.observeInboundEvent(e)
+	b.health.eventSent()
+
+	// If there are already events waiting in the queue, this one needs to go
+	// after them to keep everything in order.
+	if b.queue != nil && (!b.ingestConnected.Load() || b.queue.Len() > 0) {
+		b.queueEvent(e)
+		return
+	}
+
 	// Note that we need to allow events to be dropped so we don't lose the
 	// connection when the gRPC service is down.
 	select {
 	case b.outputStream <- e:
 	default:
+		if b.queue != nil {
+			b.queueEvent(e)
+		} else {
+			b.dropEvent(e, "output stream full")
+		}
+	}
+}
+
+func (b *Backend) queueEvent(e *pb.ChatEvent) {
+	// Responses are tied to the ingest stream the request came in on, so
+	// there's no point in replaying them on a new one.
+	if !b.ingestConnected.Load() {
+		switch e.Inner.(type) {
+		case *pb.ChatEvent_Success, *pb.ChatEvent_Failed:
+			b.dropEvent(e, "ingest stream disconnected")
+			return
+		}
+	}
+
+	// Even if writing to disk fails, the event is still kept in memory, so we
+	// only log the error.
+	err := b.queue.Push(e)
+	if err != nil {
+		b.logger.Warn().Err(err).Msg("failed to write event to queue")
 	}
+
+	b.queuedEvents.Add(1)
+}
+
+func (b *Backend) dropEvent(e *pb.ChatEvent, reason string) {
+	b.droppedEvents.Add(1)
+	b.logger.Debug().Str("reason", reason).Msgf("Dropping event: %+v", e)
 }
 
+// reportDrops logs how many events have been dropped since the last time it
+// was called.
+func (b *Backend) reportDrops() {
+	if b.queue != nil {
+		b.droppedEvents.Add(uint64(b.queue.TakeDropped()))
+	}
+
+	total := b.droppedEvents.Load()
+	prev := b.reportedDrops.Swap(total)
+	if total > prev {
+		b.logger.Warn().
+			Uint64("dropped", total-prev).
+			Uint64("dropped_total", total).
+			Msg("Events were dropped while seabird-core was unavailable")
+	}
+}
+
+// IngestState returns the state of the connection to seabird-core and when it
+// last changed.
+func (b *Backend) IngestState() (ConnState, time.Time) {
+	return b.reconnect.State()
+}
+
+// EventStats returns counters for events which were dropped or queued because
+// seabird-core was unavailable.
+func (b *Backend) EventStats() EventStats {
+	ret := EventStats{
+		Dropped:     b.droppedEvents.Load(),
+		Queued:      b.queuedEvents.Load(),
+		Replayed:    b.replayedEvents.Load(),
+		Unsupported: b.unsupportedEvents.Load(),
+	}
+
+	if b.queue != nil {
+		// TakeDropped resets the queue's count, so it needs to be added to the
+		// total or it would be lost the next time this is called.
+		b.droppedEvents.Add(uint64(b.queue.TakeDropped()))
+		ret.Dropped = b.droppedEvents.Load()
+		ret.QueueLength = b.queue.Len()
+	}
+
+	return ret
+}
+
+func (b *Backend) sendEvent(stream *seabird.SeabirdChatIngestStream, event *pb.ChatEvent) error {
+	b.logger.Debug().Msgf("Sending event: %+v", event)
+
+	err := stream.Send(event)
+	if err != nil {
+		b.logger.Warn().Err(err).Msgf("got error while sending event: %+v", event)
+	}
+
+	return err
+}
+
+// flushQueue sends any events which were queued while the ingest stream was
+// unavailable. Anything already in the output stream is older than the
+// queued events, so those are sent first.
+func (b *Backend) flushQueue(stream *seabird.SeabirdChatIngestStream) error {
+	defer b.reportDrops()
+
+	if b.queue == nil {
+		return nil
+	}
+
+	for done := false; !done; {
+		select {
+		case event := <-b.outputStream:
+			if err := b.sendEvent(stream, event); err != nil {
+				return err
+			}
+		default:
+			done = true
+		}
+	}
+
+	var replayed uint64
+	defer func() {
+		b.replayedEvents.Add(replayed)
+		if replayed > 0 {
+			b.logger.Info().Uint64("count", replayed).Msg("Replayed queued events")
+		}
+	}()
+
+	for {
+		event, ok := b.queue.Peek()
+		if !ok {
+			return nil
+		}
+
+		if err := b.sendEvent(stream, event); err != nil {
+			return err
+		}
+
+		if err := b.queue.Pop(); err != nil {
+			b.logger.Warn().Err(err).Msg("failed to update event queue")
+		}
+
+		replayed++
+	}
+}
+
+// ingestStableAfter is how long an ingest stream needs to stay open before
+// it's considered connected if no requests have been received on it.
+const ingestStableAfter = 5 * time.Second
+
 func (b *Backend) handleIngest(ctx context.Context) {
 	ingestStream, err := b.grpc.IngestEvents("discord", b.id)
 	if err != nil {
@@ -424,14 +987,60 @@ func (b *Backend) handleIngest(ctx context.Context) {
 		return
 	}
 
+	defer ingestStream.Close()
+	defer b.reconnect.Disconnected()
+
+	// gRPC streams are opened lazily, so seabird-core may still reject this
+	// one. It only counts as connected, which resets the backoff, once a
+	// request arrives or it has stayed open for a while.
+	stable := time.NewTimer(ingestStableAfter)
+	defer stable.Stop()
+
+	// Sending on a stream which is about to be rejected still succeeds, so
+	// anything sent before then would be lost. If there's a queue, events
+	// are left in it, and in the output stream, until the stream is
+	// confirmed.
+	var queueNotify <-chan struct{}
+	outputStream := b.outputStream
+	if b.queue != nil {
+		outputStream = nil
+	}
+
+	confirmed := false
+	confirm := func() error {
+		b.reconnect.Connected()
+		if confirmed {
+			return nil
+		}
+		confirmed = true
+
+		if b.queue != nil {
+			queueNotify = b.queue.C
+			outputStream = b.outputStream
+		}
+
+		return b.flushQueue(ingestStream)
+	}
+
 	for {
 		select {
-		case event := <-b.outputStream:
-			b.logger.Debug().Msgf("Sending event: %+v", event)
+		case <-ctx.Done():
+			return
 
-			err := ingestStream.Send(event)
+		case <-stable.C:
+			if err := confirm(); err != nil {
+				return
+			}
+
+		case <-queueNotify:
+			err := b.flushQueue(ingestStream)
+			if err != nil {
+				return
+			}
+
+		case event := <-outputStream:
+			err := b.sendEvent(ingestStream, event)
 			if err != nil {
-				b.logger.Warn().Err(err).Msgf("got error while sending event: %+v", event)
 				return
 			}
 
@@ -441,53 +1050,92 @@ func (b *Backend) handleIngest(ctx context.Context) {
 				return
 			}
 
+			// Requests are handled by the dispatcher so slow calls to Discord
+			// don't block the stream. It reports the result once they're done.
+			if err := confirm(); err != nil {
+				return
+			}
+			b.health.requestReceived()
+
+			requestType := oneofName(msg)
 			switch v := msg.Inner.(type) {
 			case *pb.ChatRequest_SendMessage:
-				msgText := v.SendMessage.Text
-				if c, err := b.discord.State.Channel(v.SendMessage.ChannelId); err == nil {
-					msgText = b.getReplacer(c.GuildID).Replace(msgText)
-				} else {
-					b.logger.Warn().Err(err).Msg("Tried to send message to unknown channel")
-				}
-				_, err = b.discord.ChannelMessageSendComplex(v.SendMessage.ChannelId, &discordgo.MessageSend{
-					Content: msgText,
-					Flags:   discordgo.MessageFlagsSuppressEmbeds,
+				b.dispatcher.Enqueue(&outboundMessage{
+					RequestIDs: []string{msg.Id},
+					Type:       requestType,
+					ChannelID:  v.SendMessage.ChannelId,
+					Text:       b.renderMessage(v.SendMessage.ChannelId, v.SendMessage.Text, v.SendMessage.RootBlock),
+					Tags:       v.SendMessage.Tags,
 				})
+				continue
 			case *pb.ChatRequest_SendPrivateMessage:
-				// TODO: this might not work
-				_, err = b.discord.ChannelMessageSendComplex(v.SendPrivateMessage.UserId, &discordgo.MessageSend{
-					Content: v.SendPrivateMessage.Text,
-					Flags:   discordgo.MessageFlagsSuppressEmbeds,
+				b.dispatcher.Enqueue(&outboundMessage{
+					RequestIDs: []string{msg.Id},
+					Type:       requestType,
+					UserID:     v.SendPrivateMessage.UserId,
+					Text:       b.renderPrivateMessage(v.SendPrivateMessage.Text, v.SendPrivateMessage.RootBlock),
+					Tags:       v.SendPrivateMessage.Tags,
 				})
+				continue
 			case *pb.ChatRequest_PerformAction:
-				msgText := v.PerformAction.Text
-				if c, err := b.discord.State.Channel(v.PerformAction.ChannelId); err == nil {
-					msgText = b.getReplacer(c.GuildID).Replace(msgText)
-				} else {
-					b.logger.Warn().Err(err).Msg("Tried to send message to unknown channel")
-				}
-				_, err = b.discord.ChannelMessageSendComplex(v.PerformAction.ChannelId, &discordgo.MessageSend{
-					Content: "_" + msgText + "_",
-					Flags:   discordgo.MessageFlagsSuppressEmbeds,
+				b.dispatcher.Enqueue(&outboundMessage{
+					RequestIDs: []string{msg.Id},
+					Type:       requestType,
+					ChannelID:  v.PerformAction.ChannelId,
+					Text:       b.renderMessage(v.PerformAction.ChannelId, v.PerformAction.Text, v.PerformAction.RootBlock),
+					Action:     true,
+					Tags:       v.PerformAction.Tags,
 				})
+				continue
 			case *pb.ChatRequest_PerformPrivateAction:
-				// TODO: this might not work
-				_, err = b.discord.ChannelMessageSendComplex(v.PerformPrivateAction.UserId, &discordgo.MessageSend{
-					Content: "_" + v.PerformPrivateAction.Text + "_",
-					Flags:   discordgo.MessageFlagsSuppressEmbeds,
+				b.dispatcher.Enqueue(&outboundMessage{
+					RequestIDs: []string{msg.Id},
+					Type:       requestType,
+					UserID:     v.PerformPrivateAction.UserId,
+					Text:       b.renderPrivateMessage(v.PerformPrivateAction.Text, v.PerformPrivateAction.RootBlock),
+					Action:     true,
+					Tags:       v.PerformPrivateAction.Tags,
 				})
+				continue
 			case *pb.ChatRequest_JoinChannel:
-				err = errors.New("unimplemented for discord")
+				name := v.JoinChannel.ChannelName
+				b.dispatcher.Enqueue(&outboundMessage{
+					RequestIDs: []string{msg.Id},
+					Type:       requestType,
+					ChannelID:  name,
+					Do:         func() error { return b.joinChannel(name) },
+				})
+				continue
 			case *pb.ChatRequest_LeaveChannel:
-				err = errors.New("unimplemented for discord")
+				channelID := v.LeaveChannel.ChannelId
+				b.dispatcher.Enqueue(&outboundMessage{
+					RequestIDs: []string{msg.Id},
+					Type:       requestType,
+					ChannelID:  channelID,
+					Do:         func() error { return b.leaveChannel(channelID) },
+				})
+				continue
 			case *pb.ChatRequest_UpdateChannelInfo:
-				_, err = b.discord.ChannelEditComplex(v.UpdateChannelInfo.ChannelId, &discordgo.ChannelEdit{
-					Topic: v.UpdateChannelInfo.Topic,
+				channelID := v.UpdateChannelInfo.ChannelId
+				topic := v.UpdateChannelInfo.Topic
+				b.dispatcher.Enqueue(&outboundMessage{
+					RequestIDs: []string{msg.Id},
+					Type:       requestType,
+					ChannelID:  channelID,
+					Do: func() error {
+						_, err := b.session.ChannelEditComplex(channelID, &discordgo.ChannelEdit{
+							Topic: topic,
+						})
+						return err
+					},
 				})
+				continue
 			default:
 				b.logger.Warn().Msgf("unknown msg type: %T", msg.Inner)
 			}
 
+			b.observeOutboundRequest(requestType, "", err)
+
 			if msg.Id != "" {
 				if err != nil {
 					b.writeFailure(msg.Id, err.Error())
@@ -501,6 +1149,7 @@ func (b *Backend) handleIngest(ctx context.Context) {
 
 func (b *Backend) runGrpc(ctx context.Context) error {
 	for {
+		b.reconnect.Connecting()
 		b.handleIngest(ctx)
 		b.logger.Warn().Msg("Ingest exited")
 
@@ -511,17 +1160,43 @@ func (b *Backend) runGrpc(ctx context.Context) error {
 			return err
 		}
 
-		b.logger.Info().Msg("Sleeping 5 seconds before trying ingest again")
-		time.Sleep(5 * time.Second)
+		delay, err := b.reconnect.Backoff(ctx)
+		if err != nil {
+			b.logger.Info().Msg("Bot is shutting down, exiting runGrpc")
+			return err
+		}
+
+		b.logger.Info().Dur("delay", delay).Msg("Trying ingest again")
 	}
 }
 
 func (b *Backend) Run() error {
-	errGroup, ctx := errgroup.WithContext(context.Background())
+	return b.RunContext(context.Background())
+}
+
+// RunContext runs the backend until the context is cancelled or a fatal error
+// occurs.
+func (b *Backend) RunContext(ctx context.Context) error {
+	if b.queue != nil {
+		defer b.queue.Close()
+	}
+
+	errGroup, ctx := errgroup.WithContext(ctx)
 
 	errGroup.Go(func() error {
 		return b.runGrpc(ctx)
 	})
+	errGroup.Go(func() error {
+		b.dispatcher.Run(ctx)
+		return nil
+	})
+	errGroup.Go(func() error {
+		return b.runHTTP(ctx)
+	})
+	errGroup.Go(func() error {
+		b.watchConfig(ctx)
+		return nil
+	})
 	errGroup.Go(func() error {
 		err := b.discord.Open()
 		defer b.discord.Close()
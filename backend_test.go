@@ -0,0 +1,533 @@
+package seabird_discord
+
+import (
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"github.com/seabird-chat/seabird-go/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/seabird-chat/seabird-discord-backend/internal/fakediscord"
+)
+
+var (
+	testGuild = &discordgo.Guild{
+		ID:   "1",
+		Name: "Test Guild",
+		Channels: []*discordgo.Channel{
+			{ID: "10", GuildID: "1", Name: "general", Type: discordgo.ChannelTypeGuildText},
+		},
+		Members: []*discordgo.Member{
+			{GuildID: "1", User: testUser},
+		},
+	}
+	testUser = &discordgo.User{ID: "2", Username: "alice"}
+)
+
+// newTestBackend returns a backend with a session connected to a fake Discord
+// server. There is no connection to seabird-core, so events can be read from
+// outputStream.
+func newTestBackend(t *testing.T, config DiscordConfig) (*Backend, *fakediscord.Server) {
+	fake := fakediscord.New()
+	t.Cleanup(fake.Close)
+
+	config.Logger = zerolog.Nop()
+
+	b, err := newBackend(config)
+	require.NoError(t, err)
+
+	b.discord.Client.Transport = fake.Transport()
+
+	// Handlers normally run in their own goroutines, which makes the order of
+	// events unpredictable and lets the state change under a handler which is
+	// still running.
+	b.discord.SyncEvents = true
+
+	require.NoError(t, b.discord.Open())
+	t.Cleanup(func() { b.discord.Close() })
+
+	return b, fake
+}
+
+// nextEvent returns the next event sent to seabird-core, skipping any channel
+// events.
+func nextEvent(t *testing.T, b *Backend) *pb.ChatEvent {
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case e := <-b.outputStream:
+			switch e.Inner.(type) {
+			case *pb.ChatEvent_JoinChannel, *pb.ChatEvent_LeaveChannel, *pb.ChatEvent_ChangeChannel:
+				continue
+			}
+			return e
+		case <-timeout:
+			t.Fatal("timed out waiting for event")
+			return nil
+		}
+	}
+}
+
+func TestBackendMessageCreate(t *testing.T) {
+	b, fake := newTestBackend(t, DefaultConfig())
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+
+	e := <-b.outputStream
+	require.IsType(t, &pb.ChatEvent_JoinChannel{}, e.Inner)
+	assert.Equal(t, "10", e.GetJoinChannel().ChannelId)
+	assert.Equal(t, "general", e.GetJoinChannel().DisplayName)
+
+	require.NoError(t, fake.Dispatch("MESSAGE_CREATE", &discordgo.Message{
+		ID:        "100",
+		ChannelID: "10",
+		GuildID:   "1",
+		Content:   "!weather  seattle",
+		Author:    testUser,
+	}))
+
+	e = nextEvent(t, b)
+	require.IsType(t, &pb.ChatEvent_Command{}, e.Inner)
+	assert.Equal(t, "weather", e.GetCommand().Command)
+	assert.Equal(t, "seattle", e.GetCommand().Arg)
+	assert.Equal(t, "10", e.GetCommand().Source.ChannelId)
+	assert.Equal(t, "2", e.GetCommand().Source.User.Id)
+	assert.Equal(t, "100", e.Tags[TagMessageID])
+
+	// Messages from the bot itself are ignored, so the next event should be
+	// for the message after it.
+	require.NoError(t, fake.Dispatch("MESSAGE_CREATE", &discordgo.Message{
+		ID:        "101",
+		ChannelID: "10",
+		GuildID:   "1",
+		Content:   "!ignored",
+		Author:    fake.BotUser,
+	}))
+	require.NoError(t, fake.Dispatch("MESSAGE_CREATE", &discordgo.Message{
+		ID:        "102",
+		ChannelID: "10",
+		GuildID:   "1",
+		Content:   "hello world",
+		Author:    testUser,
+	}))
+
+	e = nextEvent(t, b)
+	require.IsType(t, &pb.ChatEvent_Message{}, e.Inner)
+	assert.Equal(t, "102", e.Tags[TagMessageID])
+}
+
+func TestBackendMessageUpdate(t *testing.T) {
+	config := DefaultConfig()
+	config.ForwardEdits = true
+
+	b, fake := newTestBackend(t, config)
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+
+	edited := time.Now()
+	update := func(id, content string, editedTimestamp *time.Time) {
+		require.NoError(t, fake.Dispatch("MESSAGE_UPDATE", &discordgo.Message{
+			ID:              id,
+			ChannelID:       "10",
+			GuildID:         "1",
+			Content:         content,
+			Author:          testUser,
+			EditedTimestamp: editedTimestamp,
+		}))
+	}
+
+	// Editing a command or a mention doesn't run it again, and updates
+	// which only add embeds aren't edits at all.
+	update("100", "!weather seattle", &edited)
+	update("101", "<@1000> hello", &edited)
+	update("102", "hello world", nil)
+
+	update("103", "hello wrold", &edited)
+
+	e := nextEvent(t, b)
+	require.IsType(t, &pb.ChatEvent_Message{}, e.Inner)
+	assert.Equal(t, "hello wrold", blockText(e.GetMessage().RootBlock))
+	assert.Equal(t, "103", e.Tags[TagMessageID])
+	assert.Equal(t, "true", e.Tags[TagEdited])
+}
+
+func TestBackendMessageUpdateDisabled(t *testing.T) {
+	b, fake := newTestBackend(t, DefaultConfig())
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+
+	edited := time.Now()
+	message := func(event, id, content string) {
+		require.NoError(t, fake.Dispatch(event, &discordgo.Message{
+			ID:              id,
+			ChannelID:       "10",
+			GuildID:         "1",
+			Content:         content,
+			Author:          testUser,
+			EditedTimestamp: &edited,
+		}))
+	}
+
+	// Edits aren't forwarded by default, but they're still counted.
+	message("MESSAGE_UPDATE", "100", "hello wrold")
+	message("MESSAGE_CREATE", "101", "hi")
+
+	e := nextEvent(t, b)
+	assert.Equal(t, "101", e.Tags[TagMessageID])
+	assert.Empty(t, e.Tags[TagEdited])
+	assert.Equal(t, uint64(1), b.EventStats().Unsupported)
+
+	// The setting can be changed on reload.
+	config := testReloadConfig()
+	config.ForwardEdits = true
+	require.NoError(t, b.Reload(config))
+
+	message("MESSAGE_UPDATE", "100", "hello world")
+
+	e = nextEvent(t, b)
+	assert.Equal(t, "100", e.Tags[TagMessageID])
+	assert.Equal(t, "true", e.Tags[TagEdited])
+	assert.Equal(t, uint64(1), b.EventStats().Unsupported)
+}
+
+// nextChannelEvent returns the next join, leave or change event sent to
+// seabird-core.
+func nextChannelEvent(t *testing.T, b *Backend) *pb.ChatEvent {
+	timeout := time.After(5 * time.Second)
+
+	for {
+		select {
+		case e := <-b.outputStream:
+			switch e.Inner.(type) {
+			case *pb.ChatEvent_JoinChannel, *pb.ChatEvent_LeaveChannel, *pb.ChatEvent_ChangeChannel:
+				return e
+			}
+		case <-timeout:
+			t.Fatal("timed out waiting for channel event")
+			return nil
+		}
+	}
+}
+
+func TestBackendChannelEvents(t *testing.T) {
+	b, fake := newTestBackend(t, DefaultConfig())
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+	assert.Equal(t, "10", nextChannelEvent(t, b).GetJoinChannel().GetChannelId())
+
+	random := &discordgo.Channel{ID: "11", GuildID: "1", Name: "random", Topic: "anything", Type: discordgo.ChannelTypeGuildText}
+	voice := &discordgo.Channel{ID: "20", GuildID: "1", Name: "voice", Type: discordgo.ChannelTypeGuildVoice}
+
+	// Voice channels are ignored, so the first event is for the text
+	// channel.
+	require.NoError(t, fake.Dispatch("CHANNEL_CREATE", voice))
+	require.NoError(t, fake.Dispatch("CHANNEL_CREATE", random))
+
+	join := nextChannelEvent(t, b).GetJoinChannel()
+	require.NotNil(t, join)
+	assert.Equal(t, "11", join.ChannelId)
+	assert.Equal(t, "random", join.DisplayName)
+	assert.Equal(t, "anything", join.Topic)
+
+	voice.Name = "voice 2"
+	require.NoError(t, fake.Dispatch("CHANNEL_UPDATE", voice))
+
+	updated := *random
+	updated.Name = "off-topic"
+	updated.Topic = "something else"
+	require.NoError(t, fake.Dispatch("CHANNEL_UPDATE", &updated))
+
+	change := nextChannelEvent(t, b).GetChangeChannel()
+	require.NotNil(t, change)
+	assert.Equal(t, "11", change.ChannelId)
+	assert.Equal(t, "off-topic", change.DisplayName)
+	assert.Equal(t, "something else", change.Topic)
+
+	require.NoError(t, fake.Dispatch("CHANNEL_DELETE", voice))
+	require.NoError(t, fake.Dispatch("CHANNEL_DELETE", &updated))
+
+	leave := nextChannelEvent(t, b).GetLeaveChannel()
+	require.NotNil(t, leave)
+	assert.Equal(t, "11", leave.ChannelId)
+
+	// Muted channels don't send any events.
+	_, err := b.listening.SetListening("10", false)
+	require.NoError(t, err)
+
+	general := *testGuild.Channels[0]
+	general.Topic = "muted"
+	require.NoError(t, fake.Dispatch("CHANNEL_UPDATE", &general))
+	require.NoError(t, fake.Dispatch("CHANNEL_CREATE", random))
+
+	join = nextChannelEvent(t, b).GetJoinChannel()
+	require.NotNil(t, join)
+	assert.Equal(t, "11", join.ChannelId)
+}
+
+func TestBackendSendMessage(t *testing.T) {
+	b, fake := newTestBackend(t, DefaultConfig())
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+	require.NoError(t, fake.Dispatch("MESSAGE_CREATE", &discordgo.Message{
+		ID:        "100",
+		ChannelID: "10",
+		GuildID:   "1",
+		Content:   "!hello",
+		Author:    testUser,
+	}))
+
+	e := nextEvent(t, b)
+
+	// Replies to an event reference the message it came from.
+	err := b.deliverMessage(&outboundMessage{
+		ChannelID: "10",
+		Text:      "hello alice",
+		Tags:      map[string]string{TagReplyTo: e.Id},
+	})
+	require.NoError(t, err)
+
+	req, err := fake.WaitForRequest("POST", "/channels/10/messages", time.Second)
+	require.NoError(t, err)
+
+	var sent discordgo.MessageSend
+	require.NoError(t, req.Decode(&sent))
+	assert.Equal(t, "hello alice", sent.Content)
+	require.NotNil(t, sent.Reference)
+	assert.Equal(t, "100", sent.Reference.MessageID)
+
+	// Private messages need a DM channel to be created first.
+	fake.Handle("POST", "/users/@me/channels", func(req fakediscord.Request, params map[string]string) (interface{}, error) {
+		var data struct {
+			RecipientID string `json:"recipient_id"`
+		}
+		if err := req.Decode(&data); err != nil {
+			return nil, err
+		}
+
+		return &discordgo.Channel{
+			ID:         "30",
+			Type:       discordgo.ChannelTypeDM,
+			Recipients: []*discordgo.User{{ID: data.RecipientID}},
+		}, nil
+	})
+
+	err = b.deliverMessage(&outboundMessage{
+		UserID: "2",
+		Text:   "psst",
+	})
+	require.NoError(t, err)
+
+	req, err = fake.WaitForRequest("POST", "/users/@me/channels", time.Second)
+	require.NoError(t, err)
+
+	var dm struct {
+		RecipientID string `json:"recipient_id"`
+	}
+	require.NoError(t, req.Decode(&dm))
+	assert.Equal(t, "2", dm.RecipientID)
+
+	req, err = fake.WaitForRequest("POST", "/channels/30/messages", time.Second)
+	require.NoError(t, err)
+	require.NoError(t, req.Decode(&sent))
+	assert.Equal(t, "psst", sent.Content)
+
+	// The DM channel is reused for later messages.
+	err = b.deliverMessage(&outboundMessage{
+		UserID: "2",
+		Text:   "psst again",
+	})
+	require.NoError(t, err)
+
+	var created, dms []string
+	for _, req := range fake.Requests() {
+		switch {
+		case req.Method == "POST" && req.Path == "/api/v9/users/@me/channels":
+			created = append(created, req.Path)
+		case req.Method == "POST" && req.Path == "/api/v9/channels/30/messages":
+			var msg discordgo.MessageSend
+			require.NoError(t, req.Decode(&msg))
+			dms = append(dms, msg.Content)
+		}
+	}
+	assert.Len(t, created, 1)
+	assert.Equal(t, []string{"psst", "psst again"}, dms)
+}
+
+func TestBackendWebhookMessage(t *testing.T) {
+	b, fake := newTestBackend(t, DefaultConfig())
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+	<-b.outputStream
+
+	// webhookMessages returns the webhook executions so far.
+	webhookMessages := func() []discordgo.WebhookParams {
+		var ret []discordgo.WebhookParams
+		for _, req := range fake.Requests() {
+			if req.Method == "POST" && strings.HasPrefix(req.Path, "/api/v9/webhooks/") {
+				var params discordgo.WebhookParams
+				require.NoError(t, req.Decode(&params))
+				ret = append(ret, params)
+			}
+		}
+		return ret
+	}
+
+	tags := map[string]string{
+		TagUsername:  "bob (irc)",
+		TagAvatarURL: "https://example.com/bob.png",
+	}
+
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "hello", Tags: tags}))
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "again", Tags: tags}))
+
+	// The webhook is created once and reused.
+	webhooks := fake.Webhooks("10")
+	require.Len(t, webhooks, 1)
+	assert.Equal(t, webhookName, webhooks[0].Name)
+
+	// Messages sent through the webhook aren't sent back to seabird.
+	require.NoError(t, fake.Dispatch("MESSAGE_CREATE", &discordgo.Message{
+		ID:        "101",
+		ChannelID: "10",
+		GuildID:   "1",
+		Content:   "hello",
+		WebhookID: webhooks[0].ID,
+		Author:    &discordgo.User{ID: webhooks[0].ID, Username: "bob (irc)", Bot: true},
+	}))
+	require.NoError(t, fake.Dispatch("MESSAGE_CREATE", &discordgo.Message{
+		ID:        "102",
+		ChannelID: "10",
+		GuildID:   "1",
+		Content:   "hi bob",
+		Author:    testUser,
+	}))
+
+	e := nextEvent(t, b)
+	assert.Equal(t, "102", e.Tags[TagMessageID])
+
+	sent := webhookMessages()
+	require.Len(t, sent, 2)
+	assert.Equal(t, "hello", sent[0].Content)
+	assert.Equal(t, "bob (irc)", sent[0].Username)
+	assert.Equal(t, "https://example.com/bob.png", sent[0].AvatarURL)
+	assert.Equal(t, "again", sent[1].Content)
+
+	// If the webhook is deleted, a new one is created.
+	fake.DeleteWebhook(webhooks[0].ID)
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "still here", Tags: tags}))
+	require.Len(t, fake.Webhooks("10"), 1)
+	assert.NotEqual(t, webhooks[0].ID, fake.Webhooks("10")[0].ID)
+
+	sent = webhookMessages()
+	require.Len(t, sent, 4)
+	assert.Equal(t, "still here", sent[3].Content)
+
+	// Without a username, messages are sent as the bot unless the channel is
+	// configured to use a webhook.
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "as the bot"}))
+	assert.Len(t, webhookMessages(), 4)
+
+	config := testReloadConfig()
+	config.Channels = map[string]ChannelConfig{"10": {Webhook: true}}
+	require.NoError(t, b.Reload(config))
+
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "as the webhook"}))
+	sent = webhookMessages()
+	require.Len(t, sent, 5)
+	assert.Equal(t, "as the webhook", sent[4].Content)
+	assert.Empty(t, sent[4].Username)
+
+	// Private messages are always sent as the bot, even with a username.
+	require.NoError(t, b.deliverMessage(&outboundMessage{UserID: "2", Text: "psst", Tags: tags}))
+	assert.Len(t, webhookMessages(), 5)
+
+	dmChannelID, ok := b.dmChannels.Get("2")
+	require.True(t, ok)
+
+	req, err := fake.WaitForRequest("POST", "/channels/"+dmChannelID+"/messages", time.Second)
+	require.NoError(t, err)
+
+	var dm discordgo.MessageSend
+	require.NoError(t, req.Decode(&dm))
+	assert.Equal(t, "psst", dm.Content)
+
+	config.Channels[dmChannelID] = ChannelConfig{Webhook: true}
+	require.NoError(t, b.Reload(config))
+	require.NoError(t, b.deliverMessage(&outboundMessage{UserID: "2", Text: "psst again"}))
+	assert.Len(t, webhookMessages(), 5)
+	assert.Empty(t, fake.Webhooks(dmChannelID))
+}
+
+func TestBackendOwnWebhook(t *testing.T) {
+	b, fake := newTestBackend(t, DefaultConfig())
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+	<-b.outputStream
+
+	// lookups returns how many times webhooks have been looked up.
+	lookups := func() int {
+		var count int
+		for _, req := range fake.Requests() {
+			if req.Method == "GET" && strings.HasPrefix(req.Path, "/api/v9/webhooks/") {
+				count++
+			}
+		}
+		return count
+	}
+
+	// Webhooks from before a restart are recognized by their name and owner.
+	previous, err := b.session.WebhookCreate("10", webhookName, "")
+	require.NoError(t, err)
+	other, err := b.session.WebhookCreate("10", "other", "")
+	require.NoError(t, err)
+
+	assert.True(t, b.isOwnWebhook(previous.ID))
+	assert.False(t, b.isOwnWebhook(other.ID))
+	assert.False(t, b.isOwnWebhook("12345"))
+	assert.Equal(t, 3, lookups())
+
+	// The results are remembered, including for webhooks which don't exist.
+	assert.True(t, b.isOwnWebhook(previous.ID))
+	assert.False(t, b.isOwnWebhook(other.ID))
+	assert.False(t, b.isOwnWebhook("12345"))
+	assert.Equal(t, 3, lookups())
+
+	// Concurrent sends to a channel only create one webhook.
+	var wg sync.WaitGroup
+	webhooks := make([]*discordgo.Webhook, 5)
+	for i := range webhooks {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			webhooks[i], _ = b.channelWebhook("11")
+		}()
+	}
+	wg.Wait()
+
+	require.Len(t, fake.Webhooks("11"), 1)
+	for _, webhook := range webhooks {
+		require.NotNil(t, webhook)
+		assert.Equal(t, fake.Webhooks("11")[0].ID, webhook.ID)
+	}
+
+	// A webhook which was deleted and replaced is still ours, as its messages
+	// may still arrive.
+	fake.DeleteWebhook(webhooks[0].ID)
+	require.NoError(t, b.deliverMessage(&outboundMessage{
+		ChannelID: "11",
+		Text:      "hello",
+		Tags:      map[string]string{TagUsername: "bob (irc)"},
+	}))
+	require.Len(t, fake.Webhooks("11"), 1)
+	assert.NotEqual(t, webhooks[0].ID, fake.Webhooks("11")[0].ID)
+
+	assert.True(t, b.isOwnWebhook(webhooks[0].ID))
+	assert.True(t, b.isOwnWebhook(fake.Webhooks("11")[0].ID))
+	assert.Equal(t, 3, lookups())
+}
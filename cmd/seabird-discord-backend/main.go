@@ -1,7 +1,11 @@
 package main
 
 import (
+	"flag"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/mattn/go-isatty"
 	"github.com/rs/zerolog"
@@ -9,24 +13,137 @@ import (
 	seabird_discord "github.com/seabird-chat/seabird-discord-backend"
 )
 
-func EnvDefault(key string, def string) string {
+// The Env functions override a config value if the environment variable is
+// set, so they can be used on top of a config file.
+
+func EnvString(key string, target *string) {
 	if ret, ok := os.LookupEnv(key); ok {
-		return ret
+		*target = ret
 	}
-	return def
 }
 
-func Env(logger zerolog.Logger, key string) string {
-	ret, ok := os.LookupEnv(key)
+func EnvInt(logger zerolog.Logger, key string, target *int) {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+
+	ret, err := strconv.Atoi(raw)
+	if err != nil {
+		logger.Fatal().Err(err).Str("var", key).Msg("Invalid integer in environment variable")
+	}
+
+	*target = ret
+}
 
+func EnvFloat(logger zerolog.Logger, key string, target *float64) {
+	raw, ok := os.LookupEnv(key)
 	if !ok {
-		logger.Fatal().Str("var", key).Msg("Required environment variable not found")
+		return
+	}
+
+	ret, err := strconv.ParseFloat(raw, 64)
+	if err != nil {
+		logger.Fatal().Err(err).Str("var", key).Msg("Invalid number in environment variable")
+	}
+
+	*target = ret
+}
+
+func EnvBool(logger zerolog.Logger, key string, target *bool) {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+
+	ret, err := strconv.ParseBool(raw)
+	if err != nil {
+		logger.Fatal().Err(err).Str("var", key).Msg("Invalid boolean in environment variable")
+	}
+
+	*target = ret
+}
+
+func EnvDuration(logger zerolog.Logger, key string, target *time.Duration) {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+
+	ret, err := time.ParseDuration(raw)
+	if err != nil {
+		logger.Fatal().Err(err).Str("var", key).Msg("Invalid duration in environment variable")
 	}
 
-	return ret
+	*target = ret
+}
+
+// EnvList reads a comma separated list, skipping any empty items.
+func EnvList(key string, target *[]string) {
+	raw, ok := os.LookupEnv(key)
+	if !ok {
+		return
+	}
+
+	var ret []string
+	for _, item := range strings.Split(raw, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			ret = append(ret, item)
+		}
+	}
+
+	*target = ret
+}
+
+func applyEnv(logger zerolog.Logger, config *seabird_discord.DiscordConfig) {
+	EnvString("DISCORD_TOKEN", &config.DiscordToken)
+	EnvList("DISCORD_COMMAND_PREFIX", &config.CommandPrefixes)
+	EnvBool(logger, "DISCORD_MENTION_COMMANDS", &config.MentionCommands)
+	EnvBool(logger, "DISCORD_FORWARD_REACTIONS", &config.ForwardReactions)
+	EnvBool(logger, "DISCORD_FORWARD_EDITS", &config.ForwardEdits)
+	EnvString("SEABIRD_ID", &config.SeabirdID)
+	EnvString("SEABIRD_HOST", &config.SeabirdHost)
+	EnvString("SEABIRD_TOKEN", &config.SeabirdToken)
+
+	if raw, ok := os.LookupEnv("DISCORD_CHANNEL_MAP"); ok {
+		mapping, err := seabird_discord.ParseChannelMapping(raw)
+		if err != nil {
+			logger.Fatal().Err(err).Str("var", "DISCORD_CHANNEL_MAP").Msg("Invalid channel mapping in environment variable")
+		}
+		config.VoiceChannels = mapping
+	}
+
+	EnvString("EVENT_QUEUE_PATH", &config.EventQueuePath)
+	EnvInt(logger, "EVENT_QUEUE_MAX_SIZE", &config.EventQueueMaxSize)
+	EnvDuration(logger, "EVENT_QUEUE_MAX_AGE", &config.EventQueueMaxAge)
+
+	EnvDuration(logger, "SEABIRD_RECONNECT_MIN", &config.ReconnectBackoff.Min)
+	EnvDuration(logger, "SEABIRD_RECONNECT_MAX", &config.ReconnectBackoff.Max)
+	EnvFloat(logger, "SEABIRD_RECONNECT_JITTER", &config.ReconnectBackoff.Jitter)
+
+	EnvBool(logger, "DISCORD_SLASH_COMMANDS", &config.SlashCommands)
+	EnvList("DISCORD_SLASH_COMMAND_NAMES", &config.SlashCommandNames)
+
+	EnvString("CHANNEL_STATE_PATH", &config.ChannelStatePath)
+
+	EnvFloat(logger, "DISCORD_CHANNEL_RATE", &config.RateLimit.ChannelRate)
+	EnvInt(logger, "DISCORD_CHANNEL_BURST", &config.RateLimit.ChannelBurst)
+	EnvFloat(logger, "DISCORD_GLOBAL_RATE", &config.RateLimit.GlobalRate)
+	EnvInt(logger, "DISCORD_GLOBAL_BURST", &config.RateLimit.GlobalBurst)
+	EnvBool(logger, "DISCORD_COALESCE_MESSAGES", &config.RateLimit.Coalesce)
+	EnvInt(logger, "DISCORD_MAX_QUEUE", &config.RateLimit.MaxQueue)
+	EnvInt(logger, "DISCORD_SEND_WORKERS", &config.SendWorkers)
+
+	EnvString("HTTP_ADDR", &config.HTTPAddr)
+	EnvDuration(logger, "READY_TIMEOUT", &config.ReadyTimeout)
 }
 
 func main() {
+	configPath := flag.String("config", "", "path to a YAML config file")
+	checkConfig := flag.Bool("check-config", false, "validate the config and exit without connecting")
+	flag.Parse()
+
 	var logger zerolog.Logger
 
 	if isatty.IsTerminal(os.Stdout.Fd()) {
@@ -38,14 +155,34 @@ func main() {
 	logger = logger.With().Timestamp().Logger()
 	logger.Level(zerolog.InfoLevel)
 
-	config := seabird_discord.DiscordConfig{
-		DiscordToken:          Env(logger, "DISCORD_TOKEN"),
-		CommandPrefix:         EnvDefault("DISCORD_COMMAND_PREFIX", "!"),
-		SeabirdID:             EnvDefault("SEABIRD_ID", "seabird"),
-		SeabirdHost:           Env(logger, "SEABIRD_HOST"),
-		SeabirdToken:          Env(logger, "SEABIRD_TOKEN"),
-		DiscordChannelMapping: EnvDefault("DISCORD_CHANNEL_MAP", ""),
-		Logger:                logger,
+	// loadConfig is used both at startup and whenever the config is reloaded.
+	// Environment variables always take priority over the config file.
+	loadConfig := func() (seabird_discord.DiscordConfig, error) {
+		config := seabird_discord.DefaultConfig()
+		if *configPath != "" {
+			err := seabird_discord.LoadConfig(*configPath, &config)
+			if err != nil {
+				return config, err
+			}
+		}
+
+		applyEnv(logger, &config)
+		config.Logger = logger
+		config.ConfigPath = *configPath
+
+		return config, config.Validate()
+	}
+
+	config, err := loadConfig()
+	if err != nil {
+		logger.Fatal().Err(err).Msg("invalid config")
+	}
+
+	config.ReloadConfig = loadConfig
+
+	if *checkConfig {
+		logger.Info().Msg("Config is valid")
+		return
 	}
 
 	backend, err := seabird_discord.New(config)
@@ -0,0 +1,63 @@
+package seabird_discord
+
+import (
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// trimCommandPrefix returns text with the first matching prefix removed.
+// Prefixes are checked in order, so longer prefixes should come first.
+func trimCommandPrefix(text string, prefixes []string) (string, bool) {
+	for _, prefix := range prefixes {
+		if strings.HasPrefix(text, prefix) {
+			return strings.TrimPrefix(text, prefix), true
+		}
+	}
+
+	return text, false
+}
+
+// trimBotMention returns content with a leading mention of the bot removed.
+// Discord uses <@!id> rather than <@id> for mentions by nickname, so both
+// forms are handled.
+func trimBotMention(content, botID string) (string, bool) {
+	for _, mention := range []string{"<@" + botID + ">", "<@!" + botID + ">"} {
+		if strings.HasPrefix(content, mention) {
+			return strings.TrimSpace(strings.TrimPrefix(content, mention)), true
+		}
+	}
+
+	return content, false
+}
+
+// ParseCommand parses a message which may start with one of the given
+// prefixes. It returns false if the message isn't a command, such as a bare
+// prefix, a prefix followed by whitespace or punctuation like "!!!".
+func ParseCommand(text string, prefixes []string) (string, string, bool) {
+	rest, ok := trimCommandPrefix(text, prefixes)
+	if !ok {
+		return "", "", false
+	}
+
+	return parseCommandBody(rest)
+}
+
+// parseCommandBody splits the text after a command prefix into the command
+// and its argument. The command ends at the first whitespace character of
+// any kind, so it can never span multiple lines. Whitespace around the
+// argument is trimmed, but everything inside it, including quotes and
+// newlines, is left alone for plugins to parse.
+func parseCommandBody(text string) (string, string, bool) {
+	first, _ := utf8.DecodeRuneInString(text)
+	if !unicode.IsLetter(first) && !unicode.IsNumber(first) {
+		return "", "", false
+	}
+
+	end := strings.IndexFunc(text, unicode.IsSpace)
+	if end == -1 {
+		return text, "", true
+	}
+
+	return text[:end], strings.TrimFunc(text[end:], unicode.IsSpace), true
+}
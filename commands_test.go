@@ -0,0 +1,99 @@
+package seabird_discord
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseCommand(t *testing.T) {
+	prefixes := []string{"!!", "!", "."}
+
+	var testCases = []struct {
+		name    string
+		input   string
+		command string
+		arg     string
+		ok      bool
+	}{
+		// Simple Cases
+		{name: "command-only", input: "!help", command: "help", ok: true},
+		{name: "command-arg", input: "!weather seattle", command: "weather", arg: "seattle", ok: true},
+		{name: "multi-word-arg", input: "!tell bob hi there", command: "tell", arg: "bob hi there", ok: true},
+		{name: "other-prefix", input: ".help", command: "help", ok: true},
+		{name: "longer-prefix", input: "!!help", command: "help", ok: true},
+		{name: "number", input: "!8ball will it rain", command: "8ball", arg: "will it rain", ok: true},
+		{name: "unicode-command", input: "!météo paris", command: "météo", arg: "paris", ok: true},
+		{name: "case-preserved", input: "!Help", command: "Help", ok: true},
+
+		// Whitespace
+		{name: "trailing-space", input: "!help ", command: "help", ok: true},
+		{name: "repeated-spaces", input: "!weather   seattle  ", command: "weather", arg: "seattle", ok: true},
+		{name: "tab", input: "!weather\tseattle", command: "weather", arg: "seattle", ok: true},
+		{name: "newline", input: "!help\nme", command: "help", arg: "me", ok: true},
+		{name: "multi-line-arg", input: "!paste line one\nline two\n", command: "paste", arg: "line one\nline two", ok: true},
+		{name: "nbsp", input: "!weather\u00a0seattle", command: "weather", arg: "seattle", ok: true},
+		{name: "ideographic-space", input: "!weather\u3000seattle", command: "weather", arg: "seattle", ok: true},
+		{name: "inner-whitespace-kept", input: "!echo a  b", command: "echo", arg: "a  b", ok: true},
+
+		// Quotes are passed through to the plugin
+		{name: "quoted-arg", input: `!weather "new york"`, command: "weather", arg: `"new york"`, ok: true},
+		{name: "unbalanced-quote", input: `!say "hello`, command: "say", arg: `"hello`, ok: true},
+
+		// Not commands
+		{name: "empty", input: "", ok: false},
+		{name: "no-prefix", input: "help", ok: false},
+		{name: "bare-prefix", input: "!", ok: false},
+		{name: "bare-long-prefix", input: "!!", ok: false},
+		{name: "prefix-punctuation", input: "!!!", ok: false},
+		{name: "excited", input: "!!!!! wow", ok: false},
+		{name: "interrobang", input: "!?", ok: false},
+		{name: "ellipsis", input: "...", ok: false},
+		{name: "ellipsis-text", input: "... anyway", ok: false},
+		{name: "space-after-prefix", input: "! help", ok: false},
+		{name: "newline-after-prefix", input: "!\nhelp", ok: false},
+		{name: "emoji", input: "!🎉", ok: false},
+		{name: "prefix-mid-message", input: "hello !help", ok: false},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			command, arg, ok := ParseCommand(testCase.input, prefixes)
+			assert.Equal(t, testCase.ok, ok)
+			assert.Equal(t, testCase.command, command)
+			assert.Equal(t, testCase.arg, arg)
+		})
+	}
+}
+
+func TestTrimCommandPrefix(t *testing.T) {
+	text, ok := trimCommandPrefix("!!help me", []string{"!!", "!"})
+	assert.True(t, ok)
+	assert.Equal(t, "help me", text)
+
+	text, ok = trimCommandPrefix(".help", []string{"!", "."})
+	assert.True(t, ok)
+	assert.Equal(t, "help", text)
+
+	_, ok = trimCommandPrefix("help", []string{"!"})
+	assert.False(t, ok)
+
+	_, ok = trimCommandPrefix("!help", nil)
+	assert.False(t, ok)
+}
+
+func TestTrimBotMention(t *testing.T) {
+	text, ok := trimBotMention("<@123> help me", "123")
+	assert.True(t, ok)
+	assert.Equal(t, "help me", text)
+
+	text, ok = trimBotMention("<@!123>  help", "123")
+	assert.True(t, ok)
+	assert.Equal(t, "help", text)
+
+	_, ok = trimBotMention("<@456> help", "123")
+	assert.False(t, ok)
+
+	_, ok = trimBotMention("hello <@123>", "123")
+	assert.False(t, ok)
+}
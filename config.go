@@ -0,0 +1,300 @@
+package seabird_discord
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/rs/zerolog"
+	"gopkg.in/yaml.v3"
+)
+
+type DiscordConfig struct {
+	Logger       zerolog.Logger `yaml:"-"`
+	DiscordToken string         `yaml:"discord_token"`
+	SeabirdID    string         `yaml:"seabird_id"`
+	SeabirdHost  string         `yaml:"seabird_host"`
+	SeabirdToken string         `yaml:"seabird_token"`
+
+	// CommandPrefixes are the prefixes which mark a message as a command.
+	// They can be overridden per guild or channel.
+	CommandPrefixes []string `yaml:"command_prefixes"`
+
+	// MentionCommands treats mentioning the bot followed by a word as a
+	// command, so "@seabird help" is the same as "!help".
+	MentionCommands bool `yaml:"mention_commands"`
+
+	// ForwardReactions sends reactions to seabird as messages containing the
+	// emoji, tagged with TagReaction. It's off by default so plugins which
+	// don't know about the tag don't see them as normal messages.
+	ForwardReactions bool `yaml:"forward_reactions"`
+
+	// ForwardEdits sends edited messages to seabird again, tagged with
+	// TagEdited. It's off by default so plugins which don't know about the
+	// tag don't count every edit as a new message.
+	ForwardEdits bool `yaml:"forward_edits"`
+
+	// VoiceChannels maps Discord voice channels to the seabird channel which
+	// should be notified when someone joins them.
+	VoiceChannels map[string]string `yaml:"voice_channels"`
+
+	// EventQueuePath is where events are buffered while seabird-core is
+	// unavailable. If it is empty, events are dropped instead.
+	EventQueuePath    string        `yaml:"event_queue_path"`
+	EventQueueMaxSize int           `yaml:"event_queue_max_size"`
+	EventQueueMaxAge  time.Duration `yaml:"event_queue_max_age"`
+
+	// ReconnectBackoff controls how long to wait between attempts to connect
+	// to seabird-core. Any unset values fall back to DefaultBackoffConfig.
+	ReconnectBackoff BackoffConfig `yaml:"reconnect_backoff"`
+
+	// SlashCommands enables registering seabird commands as Discord slash
+	// commands. If SlashCommandNames is empty, the list of commands is loaded
+	// from seabird-core when connecting to Discord.
+	SlashCommands     bool     `yaml:"slash_commands"`
+	SlashCommandNames []string `yaml:"slash_command_names"`
+
+	// ChannelStatePath is where the list of channels seabird has left is
+	// stored. If it is empty, the list is only kept in memory. Every other
+	// channel the bot can see, including any created later, is listened to
+	// until it is left.
+	ChannelStatePath string `yaml:"channel_state_path"`
+
+	// RateLimit controls how quickly messages are sent to Discord. Any unset
+	// values fall back to DefaultRateLimitConfig.
+	RateLimit RateLimitConfig `yaml:"rate_limit"`
+
+	// SendWorkers is how many requests from seabird can be processed at
+	// once. Requests for the same channel are always processed in order.
+	SendWorkers int `yaml:"send_workers"`
+
+	// HTTPAddr is the address to serve metrics and health checks on, such as
+	// ":8080". If it is empty, the HTTP listener is disabled.
+	HTTPAddr string `yaml:"http_addr"`
+
+	// ReadyTimeout is how long Discord or seabird-core can be disconnected
+	// before the backend is reported as not ready.
+	ReadyTimeout time.Duration `yaml:"ready_timeout"`
+
+	// Guilds and Channels contain settings which override the global ones,
+	// keyed by ID. Channel settings take priority over guild settings.
+	Guilds   map[string]GuildConfig   `yaml:"guilds"`
+	Channels map[string]ChannelConfig `yaml:"channels"`
+
+	// ReloadConfig is called to load a fresh copy of the config on SIGHUP or
+	// when ConfigPath changes. If it is nil, reloading is disabled. Only
+	// CommandPrefixes, MentionCommands, ForwardReactions, ForwardEdits,
+	// VoiceChannels, Guilds and Channels are applied on reload; everything
+	// else needs a restart.
+	ReloadConfig func() (DiscordConfig, error) `yaml:"-"`
+
+	// ConfigPath is checked for changes every ConfigPollInterval. If either is
+	// empty, the config is only reloaded on SIGHUP.
+	ConfigPath         string        `yaml:"-"`
+	ConfigPollInterval time.Duration `yaml:"config_poll_interval"`
+}
+
+// GuildConfig contains settings for a single guild.
+type GuildConfig struct {
+	// CommandPrefixes replaces the global prefixes if it is set.
+	CommandPrefixes []string `yaml:"command_prefixes"`
+
+	// DisablePrefixCommands turns off prefix commands entirely. Mention
+	// commands still work if they are enabled.
+	DisablePrefixCommands bool `yaml:"disable_prefix_commands"`
+}
+
+// ChannelConfig contains settings for a single channel. Anything which isn't
+// set falls back to the guild's settings.
+type ChannelConfig struct {
+	CommandPrefixes       []string `yaml:"command_prefixes"`
+	DisablePrefixCommands bool     `yaml:"disable_prefix_commands"`
+
+	// Webhook sends every message to this channel through a webhook, even
+	// if it doesn't have a TagUsername tag. The bot needs the Manage
+	// Webhooks permission in the channel.
+	Webhook bool `yaml:"webhook"`
+}
+
+// DefaultConfig returns a config with the default value for every optional
+// setting.
+func DefaultConfig() DiscordConfig {
+	return DiscordConfig{
+		CommandPrefixes:   []string{"!"},
+		SeabirdID:         "seabird",
+		EventQueueMaxSize: 10 * 1024 * 1024,
+		EventQueueMaxAge:  10 * time.Minute,
+		ReconnectBackoff:  DefaultBackoffConfig,
+		RateLimit:         DefaultRateLimitConfig,
+		SendWorkers:       defaultSendWorkers,
+
+		ReadyTimeout:       defaultReadyTimeout,
+		ConfigPollInterval: 10 * time.Second,
+	}
+}
+
+// LoadConfig reads a YAML config file on top of the given config. Any keys
+// which aren't set in the file are left alone.
+func LoadConfig(path string, config *DiscordConfig) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return fmt.Errorf("failed to read config: %w", err)
+	}
+
+	dec := yaml.NewDecoder(bytes.NewReader(data))
+	dec.KnownFields(true)
+
+	err = dec.Decode(config)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return fmt.Errorf("failed to parse config %s: %w", path, err)
+	}
+
+	return nil
+}
+
+// ConfigError is a problem with a single config key.
+type ConfigError struct {
+	Key     string
+	Message string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Key + ": " + e.Message
+}
+
+// Validate checks the config for any invalid values. All problems are
+// returned, each as a ConfigError naming the offending key.
+func (c *DiscordConfig) Validate() error {
+	var errs []error
+	fail := func(key, format string, args ...interface{}) {
+		errs = append(errs, &ConfigError{Key: key, Message: fmt.Sprintf(format, args...)})
+	}
+
+	for key, value := range map[string]string{
+		"discord_token": c.DiscordToken,
+		"seabird_id":    c.SeabirdID,
+		"seabird_host":  c.SeabirdHost,
+		"seabird_token": c.SeabirdToken,
+	} {
+		if value == "" {
+			fail(key, "is required")
+		}
+	}
+
+	validatePrefixes := func(key string, prefixes []string) {
+		for _, prefix := range prefixes {
+			if prefix == "" {
+				fail(key, "must not contain an empty prefix")
+			} else if strings.IndexFunc(prefix, unicode.IsSpace) != -1 {
+				fail(key, "%q must not contain whitespace", prefix)
+			}
+		}
+	}
+
+	if len(c.CommandPrefixes) == 0 {
+		fail("command_prefixes", "is required")
+	}
+	validatePrefixes("command_prefixes", c.CommandPrefixes)
+	for id, guild := range c.Guilds {
+		validatePrefixes("guilds."+id+".command_prefixes", guild.CommandPrefixes)
+	}
+	for id, channel := range c.Channels {
+		validatePrefixes("channels."+id+".command_prefixes", channel.CommandPrefixes)
+	}
+
+	for voiceChannel, channel := range c.VoiceChannels {
+		if channel == "" {
+			fail("voice_channels."+voiceChannel, "must not be empty")
+		}
+	}
+
+	if c.EventQueueMaxSize < 0 {
+		fail("event_queue_max_size", "must not be negative")
+	}
+	if c.EventQueueMaxAge < 0 {
+		fail("event_queue_max_age", "must not be negative")
+	}
+
+	if c.ReconnectBackoff.Min < 0 {
+		fail("reconnect_backoff.min", "must not be negative")
+	}
+	if c.ReconnectBackoff.Max < 0 {
+		fail("reconnect_backoff.max", "must not be negative")
+	} else if c.ReconnectBackoff.Max > 0 && c.ReconnectBackoff.Max < c.ReconnectBackoff.Min {
+		fail("reconnect_backoff.max", "must not be less than reconnect_backoff.min")
+	}
+	if c.ReconnectBackoff.Factor != 0 && c.ReconnectBackoff.Factor < 1 {
+		fail("reconnect_backoff.factor", "must be at least 1")
+	}
+	if c.ReconnectBackoff.Jitter < 0 || c.ReconnectBackoff.Jitter > 1 {
+		fail("reconnect_backoff.jitter", "must be between 0 and 1")
+	}
+
+	if c.RateLimit.ChannelRate < 0 {
+		fail("rate_limit.channel_rate", "must not be negative")
+	}
+	if c.RateLimit.ChannelBurst < 0 {
+		fail("rate_limit.channel_burst", "must not be negative")
+	}
+	if c.RateLimit.GlobalRate < 0 {
+		fail("rate_limit.global_rate", "must not be negative")
+	}
+	if c.RateLimit.GlobalBurst < 0 {
+		fail("rate_limit.global_burst", "must not be negative")
+	}
+	if c.RateLimit.MaxQueue < 0 {
+		fail("rate_limit.max_queue", "must not be negative")
+	}
+
+	if c.SendWorkers < 0 {
+		fail("send_workers", "must not be negative")
+	}
+
+	if c.ReadyTimeout < 0 {
+		fail("ready_timeout", "must not be negative")
+	}
+
+	if c.ConfigPollInterval < 0 {
+		fail("config_poll_interval", "must not be negative")
+	}
+
+	for _, name := range c.SlashCommandNames {
+		if !slashCommandNameRegexp.MatchString(name) {
+			fail("slash_command_names", "%q is not a valid slash command name", name)
+		}
+	}
+
+	// Map iteration order is random, so we sort the errors to keep the output
+	// stable.
+	sort.Slice(errs, func(i, j int) bool {
+		return errs[i].Error() < errs[j].Error()
+	})
+
+	return errors.Join(errs...)
+}
+
+// ParseChannelMapping parses a voice channel mapping in the form
+// "voice1:channel1,voice2:channel2".
+func ParseChannelMapping(raw string) (map[string]string, error) {
+	ret := make(map[string]string)
+	if raw == "" {
+		return ret, nil
+	}
+
+	for _, item := range strings.Split(raw, ",") {
+		split := strings.SplitN(item, ":", 2)
+		if len(split) != 2 {
+			return nil, fmt.Errorf("invalid channel mapping %q", item)
+		}
+
+		ret[split[0]] = split[1]
+	}
+
+	return ret, nil
+}
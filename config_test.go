@@ -0,0 +1,88 @@
+package seabird_discord
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(path, []byte(data), 0o600))
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+discord_token: discord
+seabird_host: localhost:11235
+seabird_token: seabird
+voice_channels:
+  "123": "456"
+reconnect_backoff:
+  max: 30s
+guilds:
+  "1":
+    command_prefixes: ["?", "."]
+`)
+
+	config := DefaultConfig()
+	require.NoError(t, LoadConfig(path, &config))
+
+	assert.Equal(t, "discord", config.DiscordToken)
+	assert.Equal(t, map[string]string{"123": "456"}, config.VoiceChannels)
+	assert.Equal(t, []string{"?", "."}, config.Guilds["1"].CommandPrefixes)
+
+	// Anything not in the file keeps its default.
+	assert.Equal(t, []string{"!"}, config.CommandPrefixes)
+	assert.Equal(t, 30*time.Second, config.ReconnectBackoff.Max)
+	assert.Equal(t, DefaultBackoffConfig.Min, config.ReconnectBackoff.Min)
+
+	assert.NoError(t, config.Validate())
+
+	// An empty file is fine.
+	config = DefaultConfig()
+	require.NoError(t, LoadConfig(writeConfig(t, ""), &config))
+
+	// Unknown keys are most likely typos, so they're rejected.
+	err := LoadConfig(writeConfig(t, "discord_tokn: discord\n"), &config)
+	assert.ErrorContains(t, err, "discord_tokn")
+}
+
+func TestConfigValidate(t *testing.T) {
+	config := DefaultConfig()
+	config.SeabirdHost = "localhost:11235"
+	config.SeabirdToken = "seabird"
+	config.ReconnectBackoff.Jitter = 2
+	config.Guilds = map[string]GuildConfig{"1": {CommandPrefixes: []string{"a b"}}}
+	config.SlashCommandNames = []string{"Invalid Name"}
+
+	err := config.Validate()
+	require.Error(t, err)
+
+	assert.Equal(t, `discord_token: is required
+guilds.1.command_prefixes: "a b" must not contain whitespace
+reconnect_backoff.jitter: must be between 0 and 1
+slash_command_names: "Invalid Name" is not a valid slash command name`, err.Error())
+
+	var configErr *ConfigError
+	require.ErrorAs(t, err, &configErr)
+	assert.Equal(t, "discord_token", configErr.Key)
+}
+
+func TestParseChannelMapping(t *testing.T) {
+	mapping, err := ParseChannelMapping("a:b,c:d")
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"a": "b", "c": "d"}, mapping)
+
+	mapping, err = ParseChannelMapping("")
+	require.NoError(t, err)
+	assert.Empty(t, mapping)
+
+	_, err = ParseChannelMapping("a")
+	assert.Error(t, err)
+}
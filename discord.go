@@ -8,8 +8,8 @@ import (
 )
 
 // ComesFromDM returns true if a message comes from a DM channel
-func ComesFromDM(s *discordgo.Session, m *discordgo.MessageCreate) (bool, error) {
-	channel, err := s.State.Channel(m.ChannelID)
+func ComesFromDM(s Session, m *discordgo.MessageCreate) (bool, error) {
+	channel, err := s.State().Channel(m.ChannelID)
 	if err != nil {
 		if channel, err = s.Channel(m.ChannelID); err != nil {
 			return false, err
@@ -31,14 +31,26 @@ func ActionText(rawText string) (string, bool) {
 	return text, !strings.Contains(text, "_")
 }
 
-func ReplaceMentions(l zerolog.Logger, s *discordgo.Session, m *discordgo.Message) string {
-	rawText, err := m.ContentWithMoreMentionsReplaced(s)
+// ReplaceMentions converts any mentions and custom emoji in a message to
+// plain text. Private messages aren't part of a guild, so only user mentions
+// are replaced in those.
+func ReplaceMentions(l zerolog.Logger, s Session, m *discordgo.Message) string {
+	if m.GuildID == "" {
+		return m.ContentWithMentionsReplaced()
+	}
+
+	// ContentWithMoreMentionsReplaced only looks at the state, so we give it a
+	// session which has nothing else.
+	rawText, err := m.ContentWithMoreMentionsReplaced(&discordgo.Session{
+		State:        s.State(),
+		StateEnabled: true,
+	})
 	if err != nil {
 		l.Warn().Err(err).Msg("failed to replace mentions, falling back to less agressive mentions")
 		return rawText
 	}
 
-	guild, err := s.State.Guild(m.GuildID)
+	guild, err := s.State().Guild(m.GuildID)
 	if err != nil {
 		l.Warn().Err(err).Msg("failed to look up guild, skipping custom emoji")
 		return rawText
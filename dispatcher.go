@@ -0,0 +1,445 @@
+package seabird_discord
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
+
+// errShuttingDown is reported for anything still queued when the dispatcher
+// stops, or anything queued after it has stopped.
+var errShuttingDown = errors.New("backend is shutting down")
+
+// errQueueFull is reported for requests to a channel which already has too
+// many requests waiting.
+var errQueueFull = errors.New("too many requests queued for channel")
+
+// defaultSendWorkers is how many requests can be processed at once if it
+// isn't configured.
+const defaultSendWorkers = 4
+
+// RateLimitConfig controls how quickly messages are sent to Discord. Rates are
+// in messages per second and Burst is how many messages can be sent at once
+// before the rate applies.
+type RateLimitConfig struct {
+	ChannelRate  float64 `yaml:"channel_rate"`
+	ChannelBurst int     `yaml:"channel_burst"`
+	GlobalRate   float64 `yaml:"global_rate"`
+	GlobalBurst  int     `yaml:"global_burst"`
+
+	// Coalesce combines messages which are waiting to be sent to the same
+	// channel into a single message where possible.
+	Coalesce bool `yaml:"coalesce"`
+
+	// MaxQueue is how many requests can be waiting for a single channel.
+	// Any more fail right away, so a flood of messages to one channel
+	// can't use up all our memory.
+	MaxQueue int `yaml:"max_queue"`
+}
+
+// DefaultRateLimitConfig is used for any values which are not set. These are
+// slightly below Discord's own limits so we don't hit them.
+var DefaultRateLimitConfig = RateLimitConfig{
+	ChannelRate:  1,
+	ChannelBurst: 5,
+	GlobalRate:   40,
+	GlobalBurst:  40,
+	MaxQueue:     100,
+}
+
+func (c RateLimitConfig) withDefaults() RateLimitConfig {
+	if c.ChannelRate <= 0 {
+		c.ChannelRate = DefaultRateLimitConfig.ChannelRate
+	}
+	if c.ChannelBurst <= 0 {
+		c.ChannelBurst = DefaultRateLimitConfig.ChannelBurst
+	}
+	if c.GlobalRate <= 0 {
+		c.GlobalRate = DefaultRateLimitConfig.GlobalRate
+	}
+	if c.GlobalBurst <= 0 {
+		c.GlobalBurst = DefaultRateLimitConfig.GlobalBurst
+	}
+	if c.MaxQueue <= 0 {
+		c.MaxQueue = DefaultRateLimitConfig.MaxQueue
+	}
+
+	return c
+}
+
+// tokenBucket is a simple rate limiter. It isn't safe for concurrent use.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int, now time.Time) *tokenBucket {
+	return &tokenBucket{
+		rate:   rate,
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   now,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	b.tokens += now.Sub(b.last).Seconds() * b.rate
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+	b.last = now
+}
+
+// wait returns how long until n tokens are available. Anything costing more
+// than the burst only waits for a full bucket, and the rest is paid off by
+// anything sent after it.
+func (b *tokenBucket) wait(now time.Time, n int) time.Duration {
+	b.refill(now)
+
+	need := min(float64(n), b.burst)
+	if b.tokens >= need {
+		return 0
+	}
+
+	return time.Duration((need - b.tokens) / b.rate * float64(time.Second))
+}
+
+func (b *tokenBucket) take(n int) {
+	b.tokens -= float64(n)
+}
+
+func (b *tokenBucket) full() bool {
+	return b.tokens >= b.burst
+}
+
+// outboundMessage is a request waiting to be processed. Usually this is a
+// message to send to Discord. If UserID is set, it is sent as a DM and the
+// channel is looked up when it's sent.
+type outboundMessage struct {
+	// RequestIDs are the seabird requests this message covers. There may be
+	// more than one if messages were coalesced.
+	RequestIDs []string
+
+	// Type is the kind of request, such as "send_message", for metrics.
+	Type string
+
+	ChannelID string
+	UserID    string
+	Text      string
+	Action    bool
+	Tags      map[string]string
+
+	// Do is used for requests which aren't messages. If it is set, it is
+	// called instead of sending Text and isn't rate limited.
+	Do func() error
+}
+
+// cost returns how many messages will be sent to Discord for this request,
+// which is how many tokens it takes from the rate limits.
+func (m *outboundMessage) cost() int {
+	if m.Do != nil {
+		return 0
+	}
+
+	return len(messageChunks(m.Text, m.Action))
+}
+
+// key returns what the message should be rate limited and ordered by.
+func (m *outboundMessage) key() string {
+	if m.UserID != "" {
+		return "user:" + m.UserID
+	}
+	return m.ChannelID
+}
+
+// canCoalesce returns true if other can be appended to this message.
+func (m *outboundMessage) canCoalesce(other *outboundMessage) bool {
+	return m.Do == nil && other.Do == nil && m.Type == other.Type &&
+		!m.Action && !other.Action &&
+		len(m.Tags) == 0 && len(other.Tags) == 0 &&
+		len(m.Text)+1+len(other.Text) <= maxMessageLength
+}
+
+// dispatcher processes requests from seabird separately from the ingest stream
+// so a slow or rate limited channel doesn't block receiving requests. Requests
+// are handled by a fixed number of workers, but requests for the same channel
+// are always processed one at a time, in order.
+type dispatcher struct {
+	config  RateLimitConfig
+	workers int
+	deliver func(*outboundMessage) error
+	result  func(*outboundMessage, error)
+
+	lock     sync.Mutex
+	queues   map[string][]*outboundMessage
+	order    []string
+	inFlight map[string]bool
+	buckets  map[string]*tokenBucket
+	global   *tokenBucket
+	notify   chan struct{}
+	stopped  bool
+}
+
+func newDispatcher(config RateLimitConfig, workers int, deliver func(*outboundMessage) error, result func(*outboundMessage, error)) *dispatcher {
+	config = config.withDefaults()
+
+	if workers <= 0 {
+		workers = defaultSendWorkers
+	}
+
+	return &dispatcher{
+		config:   config,
+		workers:  workers,
+		deliver:  deliver,
+		result:   result,
+		queues:   make(map[string][]*outboundMessage),
+		inFlight: make(map[string]bool),
+		buckets:  make(map[string]*tokenBucket),
+		global:   newTokenBucket(config.GlobalRate, config.GlobalBurst, time.Now()),
+		notify:   make(chan struct{}, 1),
+	}
+}
+
+// Enqueue adds a message to be sent. If the dispatcher has stopped or the
+// channel's queue is full, the message fails right away.
+func (d *dispatcher) Enqueue(msg *outboundMessage) {
+	err := d.enqueue(msg)
+	if err != nil {
+		d.result(msg, err)
+		return
+	}
+
+	d.wake()
+}
+
+func (d *dispatcher) enqueue(msg *outboundMessage) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	if d.stopped {
+		return errShuttingDown
+	}
+
+	key := msg.key()
+	queue := d.queues[key]
+
+	if d.config.Coalesce && len(queue) > 0 && queue[len(queue)-1].canCoalesce(msg) {
+		last := queue[len(queue)-1]
+		last.RequestIDs = append(last.RequestIDs, msg.RequestIDs...)
+		last.Text += "\n" + msg.Text
+		return nil
+	}
+
+	if len(queue) >= d.config.MaxQueue {
+		return errQueueFull
+	}
+
+	if len(queue) == 0 && !d.inFlight[key] {
+		d.order = append(d.order, key)
+	}
+	d.queues[key] = append(queue, msg)
+
+	return nil
+}
+
+func (d *dispatcher) wake() {
+	select {
+	case d.notify <- struct{}{}:
+	default:
+	}
+}
+
+// next returns the next message which can be sent and marks its channel as
+// in flight until done is called. If nothing can be sent yet, it returns how
+// long to wait before trying again, or 0 if there's nothing to send.
+func (d *dispatcher) next(now time.Time) (*outboundMessage, time.Duration) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	var minWait time.Duration
+	for i, key := range d.order {
+		queue := d.queues[key]
+		msg := queue[0]
+
+		// Anything other than a message isn't rate limited. Long messages
+		// are split, so they take a token for every message sent.
+		if cost := msg.cost(); cost > 0 {
+			if globalWait := d.global.wait(now, cost); globalWait > 0 {
+				if minWait == 0 || globalWait < minWait {
+					minWait = globalWait
+				}
+				continue
+			}
+
+			bucket, ok := d.buckets[key]
+			if !ok {
+				bucket = newTokenBucket(d.config.ChannelRate, d.config.ChannelBurst, now)
+				d.buckets[key] = bucket
+			}
+
+			if wait := bucket.wait(now, cost); wait > 0 {
+				if minWait == 0 || wait < minWait {
+					minWait = wait
+				}
+				continue
+			}
+
+			bucket.take(cost)
+			d.global.take(cost)
+		}
+
+		queue[0] = nil
+		if len(queue) > 1 {
+			d.queues[key] = queue[1:]
+		} else {
+			delete(d.queues, key)
+		}
+
+		// The channel is taken out of the rotation until this message is
+		// done. When it's added back, it goes to the end so other channels
+		// get a turn.
+		d.order = append(d.order[:i:i], d.order[i+1:]...)
+		d.inFlight[key] = true
+
+		return msg, 0
+	}
+
+	return nil, minWait
+}
+
+// done marks a message as finished so the next one for its channel can be
+// sent.
+func (d *dispatcher) done(msg *outboundMessage) {
+	d.lock.Lock()
+
+	key := msg.key()
+	delete(d.inFlight, key)
+	if len(d.queues[key]) > 0 {
+		d.order = append(d.order, key)
+	}
+
+	d.lock.Unlock()
+
+	d.wake()
+}
+
+// drain removes everything which is still queued and stops anything else from
+// being queued.
+func (d *dispatcher) drain() []*outboundMessage {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	d.stopped = true
+
+	var ret []*outboundMessage
+	for _, queue := range d.queues {
+		ret = append(ret, queue...)
+	}
+
+	d.queues = make(map[string][]*outboundMessage)
+	d.order = nil
+
+	return ret
+}
+
+// cleanup removes buckets for idle channels which have fully refilled, as
+// they would behave the same as a new bucket.
+func (d *dispatcher) cleanup(now time.Time) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+
+	for key, bucket := range d.buckets {
+		if _, ok := d.queues[key]; ok {
+			continue
+		}
+
+		bucket.refill(now)
+		if bucket.full() {
+			delete(d.buckets, key)
+		}
+	}
+}
+
+// Run processes requests until the context is cancelled. Once it is, any
+// requests which are already being processed are allowed to finish and
+// anything still queued, or queued later, is reported as failed.
+func (d *dispatcher) Run(ctx context.Context) {
+	work := make(chan *outboundMessage)
+
+	var wg sync.WaitGroup
+	for i := 0; i < d.workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			for msg := range work {
+				d.result(msg, d.process(msg))
+				d.done(msg)
+			}
+		}()
+	}
+
+	d.schedule(ctx, work)
+
+	close(work)
+	wg.Wait()
+
+	for _, msg := range d.drain() {
+		d.result(msg, errShuttingDown)
+	}
+}
+
+func (d *dispatcher) process(msg *outboundMessage) error {
+	if msg.Do != nil {
+		return msg.Do()
+	}
+
+	return d.deliver(msg)
+}
+
+// schedule hands messages to workers as they become available.
+func (d *dispatcher) schedule(ctx context.Context, work chan<- *outboundMessage) {
+	cleanup := time.NewTicker(time.Minute)
+	defer cleanup.Stop()
+
+	for {
+		msg, wait := d.next(time.Now())
+		if msg != nil {
+			select {
+			case work <- msg:
+				continue
+			case <-ctx.Done():
+				// This message never made it to a worker, so it needs to be
+				// reported with the rest of the queue.
+				d.result(msg, errShuttingDown)
+				return
+			}
+		}
+
+		var timer *time.Timer
+		var timerC <-chan time.Time
+		if wait > 0 {
+			timer = time.NewTimer(wait)
+			timerC = timer.C
+		}
+
+		select {
+		case <-ctx.Done():
+		case <-d.notify:
+		case <-timerC:
+		case now := <-cleanup.C:
+			d.cleanup(now)
+		}
+
+		if timer != nil {
+			timer.Stop()
+		}
+
+		if ctx.Err() != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,290 @@
+package seabird_discord
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testMessage(id, channelID, text string) *outboundMessage {
+	return &outboundMessage{RequestIDs: []string{id}, ChannelID: channelID, Text: text}
+}
+
+func TestDispatcherRateLimit(t *testing.T) {
+	d := newDispatcher(RateLimitConfig{
+		ChannelRate:  1,
+		ChannelBurst: 2,
+		GlobalRate:   10,
+		GlobalBurst:  3,
+	}, 1, nil, nil)
+
+	now := time.Now()
+	d.global.last = now
+
+	for _, id := range []string{"a1", "a2", "a3"} {
+		d.Enqueue(testMessage(id, "a", id))
+	}
+	d.Enqueue(testMessage("b1", "b", "b1"))
+	d.Enqueue(testMessage("b2", "b", "b2"))
+
+	// Channels should take turns, with each channel limited by its burst and
+	// everything limited by the global burst.
+	var sent []string
+	for {
+		msg, wait := d.next(now)
+		if msg == nil {
+			assert.Greater(t, wait, time.Duration(0))
+			break
+		}
+		sent = append(sent, msg.RequestIDs[0])
+		d.done(msg)
+	}
+	assert.Equal(t, []string{"a1", "b1", "a2"}, sent)
+
+	// Once the global limit refills, the per-channel limit applies.
+	now = now.Add(500 * time.Millisecond)
+	msg, _ := d.next(now)
+	require.NotNil(t, msg)
+	assert.Equal(t, "b2", msg.RequestIDs[0])
+	d.done(msg)
+
+	msg, wait := d.next(now)
+	assert.Nil(t, msg)
+	assert.Equal(t, 500*time.Millisecond, wait)
+
+	now = now.Add(wait)
+	msg, _ = d.next(now)
+	require.NotNil(t, msg)
+	assert.Equal(t, "a3", msg.RequestIDs[0])
+	d.done(msg)
+
+	msg, wait = d.next(now)
+	assert.Nil(t, msg)
+	assert.Equal(t, time.Duration(0), wait)
+}
+
+func TestDispatcherRateLimitLongMessages(t *testing.T) {
+	d := newDispatcher(RateLimitConfig{
+		ChannelRate:  1,
+		ChannelBurst: 5,
+		GlobalRate:   100,
+		GlobalBurst:  100,
+	}, 1, nil, nil)
+
+	now := time.Now()
+	d.global.last = now
+
+	// Messages which are split take a token for every chunk.
+	d.Enqueue(testMessage("a1", "a", strings.Repeat("word ", 1000)))
+	d.Enqueue(testMessage("a2", "a", "short"))
+
+	msg, _ := d.next(now)
+	require.NotNil(t, msg)
+	assert.Equal(t, "a1", msg.RequestIDs[0])
+	assert.Equal(t, 3, msg.cost())
+	d.done(msg)
+
+	msg, _ = d.next(now)
+	require.NotNil(t, msg)
+	assert.Equal(t, "a2", msg.RequestIDs[0])
+	d.done(msg)
+
+	// Anything costing more than the burst waits for a full bucket, and the
+	// rest is paid off afterwards.
+	d.Enqueue(testMessage("a3", "a", strings.Repeat("word ", 3000)))
+
+	msg, wait := d.next(now)
+	assert.Nil(t, msg)
+	assert.Equal(t, 4*time.Second, wait)
+
+	now = now.Add(wait)
+	msg, _ = d.next(now)
+	require.NotNil(t, msg)
+	assert.Equal(t, 8, msg.cost())
+	d.done(msg)
+
+	d.Enqueue(testMessage("a4", "a", "short"))
+
+	msg, wait = d.next(now)
+	assert.Nil(t, msg)
+	assert.Equal(t, 4*time.Second, wait)
+}
+
+func TestDispatcherCoalesce(t *testing.T) {
+	d := newDispatcher(RateLimitConfig{Coalesce: true}, 1, nil, nil)
+
+	d.Enqueue(testMessage("1", "a", "hello"))
+	d.Enqueue(testMessage("2", "a", "world"))
+	d.Enqueue(&outboundMessage{RequestIDs: []string{"3"}, ChannelID: "a", Text: "waves", Action: true})
+	d.Enqueue(testMessage("4", "a", "again"))
+	d.Enqueue(testMessage("5", "b", "other"))
+
+	var sent []*outboundMessage
+	for {
+		msg, _ := d.next(time.Now())
+		if msg == nil {
+			break
+		}
+		sent = append(sent, msg)
+		d.done(msg)
+	}
+
+	require.Len(t, sent, 4)
+	assert.Equal(t, []string{"1", "2"}, sent[0].RequestIDs)
+	assert.Equal(t, "hello\nworld", sent[0].Text)
+	assert.Equal(t, []string{"5"}, sent[1].RequestIDs)
+	assert.Equal(t, []string{"3"}, sent[2].RequestIDs)
+	assert.Equal(t, []string{"4"}, sent[3].RequestIDs)
+}
+
+func TestDispatcherOrdering(t *testing.T) {
+	d := newDispatcher(RateLimitConfig{}, 1, nil, nil)
+
+	// Only one message per channel can be in flight at a time.
+	d.Enqueue(testMessage("a1", "a", "a1"))
+	d.Enqueue(testMessage("a2", "a", "a2"))
+	d.Enqueue(testMessage("b1", "b", "b1"))
+
+	a1, _ := d.next(time.Now())
+	require.NotNil(t, a1)
+	assert.Equal(t, "a1", a1.RequestIDs[0])
+
+	b1, _ := d.next(time.Now())
+	require.NotNil(t, b1)
+	assert.Equal(t, "b1", b1.RequestIDs[0])
+
+	msg, _ := d.next(time.Now())
+	assert.Nil(t, msg)
+
+	d.done(a1)
+	msg, _ = d.next(time.Now())
+	require.NotNil(t, msg)
+	assert.Equal(t, "a2", msg.RequestIDs[0])
+}
+
+func TestDispatcherRun(t *testing.T) {
+	var lock sync.Mutex
+	var delivered []string
+	results := make(map[string]error)
+
+	block := make(chan struct{})
+
+	d := newDispatcher(RateLimitConfig{ChannelBurst: 1, ChannelRate: 0.001}, 2, func(msg *outboundMessage) error {
+		lock.Lock()
+		delivered = append(delivered, msg.Text)
+		lock.Unlock()
+		return nil
+	}, func(msg *outboundMessage, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, id := range msg.RequestIDs {
+			results[id] = err
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		d.Run(ctx)
+		close(done)
+	}()
+
+	// Other requests aren't rate limited, but they still block their channel
+	// until they're finished.
+	started := make(chan struct{})
+	d.Enqueue(&outboundMessage{RequestIDs: []string{"edit"}, ChannelID: "a", Do: func() error {
+		close(started)
+		<-block
+		return errors.New("failed")
+	}})
+	d.Enqueue(testMessage("a1", "a", "a1"))
+	d.Enqueue(testMessage("a2", "a", "a2"))
+	d.Enqueue(testMessage("b1", "b", "b1"))
+
+	<-started
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(results) == 1
+	}, time.Second, time.Millisecond)
+
+	close(block)
+	assert.Eventually(t, func() bool {
+		lock.Lock()
+		defer lock.Unlock()
+		return len(results) == 3
+	}, time.Second, time.Millisecond)
+
+	// The second message for a is rate limited, so it should still be queued
+	// when we shut down.
+	cancel()
+	<-done
+
+	lock.Lock()
+	defer lock.Unlock()
+
+	assert.Equal(t, []string{"b1", "a1"}, delivered)
+	assert.EqualError(t, results["edit"], "failed")
+	assert.NoError(t, results["a1"])
+	assert.NoError(t, results["b1"])
+	assert.ErrorIs(t, results["a2"], errShuttingDown)
+}
+
+func TestDispatcherQueueLimit(t *testing.T) {
+	results := make(map[string]error)
+	d := newDispatcher(RateLimitConfig{MaxQueue: 2}, 1, nil, func(msg *outboundMessage, err error) {
+		for _, id := range msg.RequestIDs {
+			results[id] = err
+		}
+	})
+
+	d.Enqueue(testMessage("a1", "a", "a1"))
+	d.Enqueue(testMessage("a2", "a", "a2"))
+	d.Enqueue(testMessage("a3", "a", "a3"))
+	d.Enqueue(testMessage("b1", "b", "b1"))
+
+	// Only the channel which is full rejects requests.
+	assert.ErrorIs(t, results["a3"], errQueueFull)
+	assert.Len(t, results, 1)
+
+	// Once there's room again, requests are accepted.
+	msg, _ := d.next(time.Now())
+	require.NotNil(t, msg)
+	d.done(msg)
+
+	d.Enqueue(testMessage("a4", "a", "a4"))
+	assert.Len(t, results, 1)
+}
+
+func TestDispatcherStopped(t *testing.T) {
+	var lock sync.Mutex
+	results := make(map[string]error)
+
+	d := newDispatcher(RateLimitConfig{}, 1, func(msg *outboundMessage) error {
+		return nil
+	}, func(msg *outboundMessage, err error) {
+		lock.Lock()
+		defer lock.Unlock()
+		for _, id := range msg.RequestIDs {
+			results[id] = err
+		}
+	})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	d.Run(ctx)
+
+	// Nothing is left to process requests, so they fail right away rather
+	// than waiting forever.
+	d.Enqueue(testMessage("a1", "a", "a1"))
+
+	lock.Lock()
+	defer lock.Unlock()
+	assert.ErrorIs(t, results["a1"], errShuttingDown)
+}
@@ -0,0 +1,211 @@
+package seabird_discord
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// defaultReadyTimeout is how long either connection can be down before the
+// backend is reported as not ready.
+const defaultReadyTimeout = 30 * time.Second
+
+// healthTracker records what's needed to report on the health of the backend
+// which isn't tracked anywhere else.
+type healthTracker struct {
+	lock sync.Mutex
+
+	gatewayState ConnState
+	gatewaySince time.Time
+
+	// These are set the first time each side connects, so we can tell a
+	// connection which has never come up from a short disconnect.
+	gatewayConnected bool
+	ingestConnected  bool
+
+	// These are when each side last stopped being connected. Reconnect
+	// attempts change the state without the connection coming back, so the
+	// time of the current state can't be used to tell how long it's been down.
+	gatewayDown time.Time
+	ingestDown  time.Time
+
+	lastEvent   time.Time
+	lastRequest time.Time
+}
+
+func newHealthTracker() *healthTracker {
+	return &healthTracker{
+		gatewayState: ConnStateDisconnected,
+		gatewaySince: time.Now(),
+	}
+}
+
+func (h *healthTracker) setGatewayState(state ConnState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if state == ConnStateConnected {
+		h.gatewayConnected = true
+	}
+
+	if h.gatewayState != state {
+		if h.gatewayState == ConnStateConnected {
+			h.gatewayDown = time.Now()
+		}
+
+		h.gatewayState = state
+		h.gatewaySince = time.Now()
+	}
+}
+
+// ingestStateChanged is called whenever the state of the ingest stream
+// changes.
+func (h *healthTracker) ingestStateChanged(prev, next ConnState) {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	if next == ConnStateConnected {
+		h.ingestConnected = true
+	}
+
+	if prev == ConnStateConnected {
+		h.ingestDown = time.Now()
+	}
+}
+
+// eventSent records that an event was sent to seabird.
+func (h *healthTracker) eventSent() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastEvent = time.Now()
+}
+
+// requestReceived records that a request was received from seabird.
+func (h *healthTracker) requestReceived() {
+	h.lock.Lock()
+	defer h.lock.Unlock()
+
+	h.lastRequest = time.Now()
+}
+
+func (b *Backend) handleConnect(s *discordgo.Session, m *discordgo.Connect) {
+	b.health.setGatewayState(ConnStateConnected)
+}
+
+func (b *Backend) handleDisconnect(s *discordgo.Session, m *discordgo.Disconnect) {
+	b.health.setGatewayState(ConnStateDisconnected)
+}
+
+// ConnStatus is the state of a single connection.
+type ConnStatus struct {
+	State string    `json:"state"`
+	Since time.Time `json:"since"`
+	Ready bool      `json:"ready"`
+}
+
+// HealthStatus is reported by the health and readiness endpoints.
+type HealthStatus struct {
+	Ready   bool       `json:"ready"`
+	Gateway ConnStatus `json:"gateway"`
+	Ingest  ConnStatus `json:"ingest"`
+	Guilds  int        `json:"guilds"`
+
+	// LastEvent is when an event was last sent to seabird and LastRequest is
+	// when a request was last received from it. They're omitted if it hasn't
+	// happened yet.
+	LastEvent   *time.Time `json:"last_event,omitempty"`
+	LastRequest *time.Time `json:"last_request,omitempty"`
+
+	Events struct {
+		Dropped     uint64 `json:"dropped"`
+		Queued      uint64 `json:"queued"`
+		Replayed    uint64 `json:"replayed"`
+		QueueLength int    `json:"queue_length"`
+		Unsupported uint64 `json:"unsupported"`
+	} `json:"events"`
+}
+
+// connReady returns true if a connection is up, or has only been down since
+// the given time for a short while. A connection which has never come up
+// isn't ready.
+func connReady(state ConnState, down time.Time, everConnected bool, timeout time.Duration, now time.Time) bool {
+	if state == ConnStateConnected {
+		return true
+	}
+
+	return everConnected && now.Sub(down) <= timeout
+}
+
+// Health returns the current health of the backend.
+func (b *Backend) Health() HealthStatus {
+	now := time.Now()
+
+	var ret HealthStatus
+
+	ingestState, ingestSince := b.IngestState()
+
+	b.health.lock.Lock()
+	ret.Gateway = ConnStatus{
+		State: b.health.gatewayState.String(),
+		Since: b.health.gatewaySince,
+		Ready: connReady(b.health.gatewayState, b.health.gatewayDown, b.health.gatewayConnected, b.readyTimeout, now),
+	}
+	ret.Ingest = ConnStatus{
+		State: ingestState.String(),
+		Since: ingestSince,
+		Ready: connReady(ingestState, b.health.ingestDown, b.health.ingestConnected, b.readyTimeout, now),
+	}
+	if !b.health.lastEvent.IsZero() {
+		lastEvent := b.health.lastEvent
+		ret.LastEvent = &lastEvent
+	}
+	if !b.health.lastRequest.IsZero() {
+		lastRequest := b.health.lastRequest
+		ret.LastRequest = &lastRequest
+	}
+	b.health.lock.Unlock()
+
+	ret.Ready = ret.Gateway.Ready && ret.Ingest.Ready
+
+	b.session.State().RLock()
+	ret.Guilds = len(b.session.State().Guilds)
+	b.session.State().RUnlock()
+
+	stats := b.EventStats()
+	ret.Events.Dropped = stats.Dropped
+	ret.Events.Queued = stats.Queued
+	ret.Events.Replayed = stats.Replayed
+	ret.Events.QueueLength = stats.QueueLength
+	ret.Events.Unsupported = stats.Unsupported
+
+	return ret
+}
+
+// handleHealthz reports the health of the backend. As long as we're able to
+// respond, the process is alive, so this always succeeds.
+func (b *Backend) handleHealthz(w http.ResponseWriter, r *http.Request) {
+	writeHealth(w, http.StatusOK, b.Health())
+}
+
+// handleReadyz fails if either Discord or seabird-core has been disconnected
+// for longer than the ready timeout.
+func (b *Backend) handleReadyz(w http.ResponseWriter, r *http.Request) {
+	status := b.Health()
+
+	code := http.StatusOK
+	if !status.Ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	writeHealth(w, code, status)
+}
+
+func writeHealth(w http.ResponseWriter, code int, status HealthStatus) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(status)
+}
@@ -0,0 +1,124 @@
+package seabird_discord
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestConnReady(t *testing.T) {
+	now := time.Now()
+
+	assert.True(t, connReady(ConnStateConnected, now, true, time.Minute, now))
+
+	// A connection which has never come up isn't ready, even within the
+	// timeout.
+	assert.False(t, connReady(ConnStateConnecting, now, false, time.Minute, now))
+
+	assert.True(t, connReady(ConnStateBackoff, now.Add(-30*time.Second), true, time.Minute, now))
+	assert.False(t, connReady(ConnStateBackoff, now.Add(-2*time.Minute), true, time.Minute, now))
+}
+
+func TestHealthEndpoints(t *testing.T) {
+	session := newFakeSession(t)
+
+	b := &Backend{
+		session:      session,
+		reconnect:    newReconnectManager(BackoffConfig{}),
+		health:       newHealthTracker(),
+		readyTimeout: time.Minute,
+	}
+	b.metrics = newMetrics(b)
+	b.reconnect.OnStateChange(b.health.ingestStateChanged)
+
+	handler := b.httpHandler()
+	get := func(path string) (int, HealthStatus) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, path, nil))
+
+		var status HealthStatus
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &status))
+		return rec.Code, status
+	}
+
+	// Nothing has connected yet, so we're alive but not ready.
+	code, status := get("/healthz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.False(t, status.Ready)
+	assert.Equal(t, "disconnected", status.Gateway.State)
+
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+
+	b.health.setGatewayState(ConnStateConnected)
+	code, status = get("/readyz")
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.True(t, status.Gateway.Ready)
+	assert.False(t, status.Ingest.Ready)
+
+	b.reconnect.Connected()
+	b.health.requestReceived()
+	require.NoError(t, session.State().GuildAdd(&discordgo.Guild{ID: "1"}))
+
+	code, status = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, status.Ready)
+	assert.Equal(t, "connected", status.Ingest.State)
+	assert.Equal(t, 1, status.Guilds)
+	assert.NotNil(t, status.LastRequest)
+	assert.Nil(t, status.LastEvent)
+
+	// A short disconnect doesn't affect readiness.
+	b.reconnect.Disconnected()
+	code, _ = get("/readyz")
+	assert.Equal(t, http.StatusOK, code)
+}
+
+func TestHealthReadyDuringReconnect(t *testing.T) {
+	b := &Backend{
+		session:      newFakeSession(t),
+		reconnect:    newReconnectManager(BackoffConfig{Min: 5 * time.Millisecond, Max: 5 * time.Millisecond}),
+		health:       newHealthTracker(),
+		readyTimeout: 50 * time.Millisecond,
+	}
+	b.reconnect.OnStateChange(b.health.ingestStateChanged)
+	b.health.setGatewayState(ConnStateConnected)
+
+	b.reconnect.Connecting()
+	b.reconnect.Connected()
+	assert.True(t, b.Health().Ready)
+
+	// Every attempt to reconnect changes the state, but the connection has
+	// been down the whole time, so it stops being ready after the timeout.
+	b.reconnect.Disconnected()
+	for start := time.Now(); time.Since(start) < 2*b.readyTimeout; {
+		_, err := b.reconnect.Backoff(context.Background())
+		require.NoError(t, err)
+		b.reconnect.Connecting()
+		b.reconnect.Disconnected()
+	}
+
+	status := b.Health()
+	assert.False(t, status.Ready)
+	assert.False(t, status.Ingest.Ready)
+	assert.True(t, status.Gateway.Ready)
+
+	b.reconnect.Connecting()
+	b.reconnect.Connected()
+	assert.True(t, b.Health().Ready)
+
+	// The same goes for the gateway.
+	b.health.setGatewayState(ConnStateDisconnected)
+	for start := time.Now(); time.Since(start) < 2*b.readyTimeout; time.Sleep(5 * time.Millisecond) {
+		b.health.setGatewayState(ConnStateConnecting)
+		b.health.setGatewayState(ConnStateDisconnected)
+	}
+	assert.False(t, b.Health().Gateway.Ready)
+}
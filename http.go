@@ -0,0 +1,59 @@
+package seabird_discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// httpShutdownTimeout is how long in-flight HTTP requests are given to finish
+// when shutting down.
+const httpShutdownTimeout = 5 * time.Second
+
+func (b *Backend) httpHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(b.metrics.registry, promhttp.HandlerOpts{}))
+	mux.HandleFunc("/healthz", b.handleHealthz)
+	mux.HandleFunc("/readyz", b.handleReadyz)
+	return mux
+}
+
+// runHTTP serves the HTTP endpoints until the context is cancelled. If no
+// address is configured, it does nothing.
+func (b *Backend) runHTTP(ctx context.Context) error {
+	if b.httpAddr == "" {
+		return nil
+	}
+
+	server := &http.Server{
+		Addr:              b.httpAddr,
+		Handler:           b.httpHandler(),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+
+	errs := make(chan error, 1)
+	go func() {
+		b.logger.Info().Str("addr", b.httpAddr).Msg("Starting HTTP listener")
+		errs <- server.ListenAndServe()
+	}()
+
+	select {
+	case err := <-errs:
+		return fmt.Errorf("HTTP listener failed: %w", err)
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), httpShutdownTimeout)
+	defer cancel()
+
+	err := server.Shutdown(shutdownCtx)
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
@@ -0,0 +1,351 @@
+package seabird_discord
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+
+	"github.com/seabird-chat/seabird-go/pb"
+)
+
+// interactionReplyTimeout is how long after a slash command is used that
+// replies to it are sent as the response to the interaction.
+const interactionReplyTimeout = 30 * time.Second
+
+// slashCommandArgOption is the name of the free-form argument option added to
+// every slash command.
+const slashCommandArgOption = "args"
+
+// slashCommandNameRegexp matches names Discord accepts for slash commands.
+var slashCommandNameRegexp = regexp.MustCompile(`^[-_\p{Ll}\p{N}]{1,32}$`)
+
+type pendingInteraction struct {
+	interaction *discordgo.Interaction
+	seq         uint64
+	replied     bool
+	claimed     bool
+}
+
+// interactionTracker keeps track of slash commands which are waiting for a
+// reply from seabird. They're keyed by the ID of the command event sent to
+// seabird, which replies reference with TagReplyTo.
+type interactionTracker struct {
+	lock    sync.Mutex
+	pending map[string]*pendingInteraction
+	nextSeq uint64
+}
+
+func newInteractionTracker() *interactionTracker {
+	return &interactionTracker{
+		pending: make(map[string]*pendingInteraction),
+	}
+}
+
+// add starts tracking an interaction. Once the timeout passes, onExpire is
+// called with whether any replies were sent.
+func (t *interactionTracker) add(eventID string, i *discordgo.Interaction, timeout time.Duration, onExpire func(replied bool)) {
+	t.lock.Lock()
+	t.nextSeq++
+	t.pending[eventID] = &pendingInteraction{interaction: i, seq: t.nextSeq}
+	t.lock.Unlock()
+
+	time.AfterFunc(timeout, func() {
+		onExpire(t.remove(eventID))
+	})
+}
+
+func (t *interactionTracker) remove(eventID string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	p, ok := t.pending[eventID]
+	if !ok {
+		return false
+	}
+
+	delete(t.pending, eventID)
+
+	return p.replied
+}
+
+// has returns true if the event is a slash command which is still waiting for
+// replies.
+func (t *interactionTracker) has(eventID string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, ok := t.pending[eventID]
+	return ok
+}
+
+// claim returns the event ID of the oldest interaction in a channel which
+// hasn't had a reply yet. Most plugins reply without any tags, so this lets
+// the first untagged message to the channel be used as the response. Each
+// interaction can only be claimed once.
+func (t *interactionTracker) claim(channelID string) (string, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var ret string
+	var oldest *pendingInteraction
+	for eventID, p := range t.pending {
+		if p.replied || p.claimed || p.interaction.ChannelID != channelID {
+			continue
+		}
+
+		if oldest == nil || p.seq < oldest.seq {
+			ret, oldest = eventID, p
+		}
+	}
+
+	if oldest == nil {
+		return "", false
+	}
+
+	oldest.claimed = true
+
+	return ret, true
+}
+
+// take returns the interaction a reply to the given event in the given channel
+// should be sent as the response to, if there is one. The second return value
+// is true if this is the first reply. Any others should be sent as follow-ups.
+func (t *interactionTracker) take(eventID, channelID string) (*discordgo.Interaction, bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	p, ok := t.pending[eventID]
+	if !ok || p.interaction.ChannelID != channelID {
+		return nil, false
+	}
+
+	first := !p.replied
+	p.replied = true
+
+	return p.interaction, first
+}
+
+// loadSlashCommands builds the list of slash commands to register, either
+// from the configured names or from the commands registered with seabird.
+func (b *Backend) loadSlashCommands() ([]*discordgo.ApplicationCommand, error) {
+	descriptions := make(map[string]string)
+
+	if len(b.slashCommandNames) > 0 {
+		for _, name := range b.slashCommandNames {
+			descriptions[name] = ""
+		}
+	} else {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		resp, err := b.seabird.Inner.RegisteredCommands(ctx, &pb.CommandsRequest{})
+		if err != nil {
+			return nil, fmt.Errorf("failed to load commands from seabird: %w", err)
+		}
+
+		for name, meta := range resp.Commands {
+			descriptions[name] = meta.GetShortHelp()
+		}
+	}
+
+	var ret []*discordgo.ApplicationCommand
+	for name, desc := range descriptions {
+		if !slashCommandNameRegexp.MatchString(name) {
+			b.logger.Warn().Str("command", name).Msg("Skipping command which is not a valid slash command name")
+			continue
+		}
+
+		// Descriptions are required and limited to 100 characters.
+		desc = strings.TrimSpace(desc)
+		if desc == "" {
+			desc = fmt.Sprintf("Run the %s command", name)
+		}
+		if runes := []rune(desc); len(runes) > 100 {
+			desc = string(runes[:99]) + "…"
+		}
+
+		ret = append(ret, &discordgo.ApplicationCommand{
+			Name:        name,
+			Description: desc,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        slashCommandArgOption,
+					Description: "Arguments to pass to the command",
+				},
+			},
+		})
+	}
+
+	sort.Slice(ret, func(i, j int) bool { return ret[i].Name < ret[j].Name })
+
+	return ret, nil
+}
+
+func (b *Backend) registerSlashCommands(appID string) {
+	commands, err := b.loadSlashCommands()
+	if err != nil {
+		b.logger.Warn().Err(err).Msg("failed to load slash commands")
+		return
+	}
+
+	// Overwriting replaces any commands which no longer exist.
+	_, err = b.session.ApplicationCommandBulkOverwrite(appID, "", commands)
+	if err != nil {
+		b.logger.Warn().Err(err).Msg("failed to register slash commands")
+		return
+	}
+
+	b.logger.Info().Int("count", len(commands)).Msg("Registered slash commands")
+}
+
+func (b *Backend) handleReady(s *discordgo.Session, m *discordgo.Ready) {
+	if !b.slashCommands {
+		return
+	}
+
+	// Commands belong to the application, which doesn't always have the same
+	// ID as the bot user.
+	if m.Application == nil {
+		b.logger.Warn().Msg("got ready event without an application, skipping slash commands")
+		return
+	}
+
+	go b.registerSlashCommands(m.Application.ID)
+}
+
+func (b *Backend) handleInteractionCreate(s *discordgo.Session, m *discordgo.InteractionCreate) {
+	if m.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+
+	user := m.User
+	if m.Member != nil {
+		user = m.Member.User
+	}
+	if user == nil {
+		b.logger.Warn().Msg("got interaction without a user")
+		return
+	}
+
+	if !b.listening.IsListening(m.ChannelID) {
+		err := b.session.InteractionRespond(m.Interaction, &discordgo.InteractionResponse{
+			Type: discordgo.InteractionResponseChannelMessageWithSource,
+			Data: &discordgo.InteractionResponseData{
+				Content: "Commands are disabled in this channel.",
+				Flags:   discordgo.MessageFlagsEphemeral,
+			},
+		})
+		if err != nil {
+			b.logger.Warn().Err(err).Msg("failed to respond to interaction")
+		}
+		return
+	}
+
+	data := m.ApplicationCommandData()
+
+	var arg string
+	for _, opt := range data.Options {
+		if opt.Name == slashCommandArgOption {
+			arg = opt.StringValue()
+		}
+	}
+
+	// We don't know how long seabird will take to respond, so we let Discord
+	// know the response will come later.
+	err := b.session.InteractionRespond(m.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseDeferredChannelMessageWithSource,
+	})
+	if err != nil {
+		b.logger.Warn().Err(err).Msg("failed to respond to interaction")
+		return
+	}
+
+	// Replies are matched up with the interaction by the ID of the event, so
+	// unrelated messages to the channel are sent as normal.
+	eventID := newEventID()
+	b.recentMessages.Add(eventID, messageContext{
+		GuildID:   m.GuildID,
+		ChannelID: m.ChannelID,
+	})
+
+	b.interactions.add(eventID, m.Interaction, interactionReplyTimeout, func(replied bool) {
+		// If nothing replied, we clean up the deferred response so it isn't
+		// left in a loading state.
+		if !replied {
+			err := b.session.InteractionResponseDelete(m.Interaction)
+			if err != nil {
+				b.logger.Warn().Err(err).Msg("failed to clean up interaction response")
+			}
+		}
+	})
+
+	b.writeEvent(&pb.ChatEvent{
+		Id: eventID,
+		Inner: &pb.ChatEvent_Command{Command: &pb.CommandEvent{
+			Source: &pb.ChannelSource{
+				ChannelId: m.ChannelID,
+				User: &pb.User{
+					Id:          user.ID,
+					DisplayName: user.Username,
+				},
+			},
+			Command: data.Name,
+			Arg:     arg,
+		}},
+	})
+}
+
+// sendChannelMessage sends a message to a channel. If the tags reply to a slash
+// command which is still waiting, the message is sent as the response to it
+// instead, unless it's being sent as someone else. Otherwise, it's sent
+// through a webhook if the channel or tags call for one, or if the tags
+// reference a recent message, it will be sent as a reply.
+func (b *Backend) sendChannelMessage(channelID string, private bool, content string, tags map[string]string) error {
+	if !b.listening.IsListening(channelID) {
+		return errors.New("not listening in channel")
+	}
+
+	// Messages sent with a custom identity are usually relayed from somewhere
+	// else, so they shouldn't be used as the response to a slash command.
+	var interaction *discordgo.Interaction
+	var first bool
+	if tags[TagUsername] == "" {
+		interaction, first = b.interactions.take(tags[TagReplyTo], channelID)
+	}
+
+	if interaction != nil {
+		if first {
+			_, err := b.session.InteractionResponseEdit(interaction, &discordgo.WebhookEdit{
+				Content: &content,
+			})
+			return err
+		}
+
+		_, err := b.session.FollowupMessageCreate(interaction, true, &discordgo.WebhookParams{
+			Content: content,
+			Flags:   discordgo.MessageFlagsSuppressEmbeds,
+		})
+		return err
+	}
+
+	// Webhooks only exist in guild channels, so the identity tags and the
+	// channel config are ignored for private messages.
+	if !private && b.settings.Load().useWebhook(channelID, tags) {
+		return b.sendWebhookMessage(channelID, content, tags)
+	}
+
+	_, err := b.session.ChannelMessageSendComplex(channelID, &discordgo.MessageSend{
+		Content:   content,
+		Flags:     discordgo.MessageFlagsSuppressEmbeds,
+		Reference: b.messageReference(channelID, tags),
+	})
+	return err
+}
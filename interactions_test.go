@@ -0,0 +1,192 @@
+package seabird_discord
+
+import (
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/seabird-chat/seabird-go/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestInteractionTracker(t *testing.T) {
+	tracker := newInteractionTracker()
+
+	first := &discordgo.Interaction{ID: "1", ChannelID: "chan"}
+	second := &discordgo.Interaction{ID: "2", ChannelID: "chan"}
+
+	expired := make(chan bool, 2)
+	tracker.add("event-1", first, time.Hour, func(replied bool) { expired <- replied })
+	tracker.add("event-2", second, 10*time.Millisecond, func(replied bool) { expired <- replied })
+
+	// Replies are only matched by event, so other messages to the channel
+	// aren't used.
+	i, isFirst := tracker.take("", "chan")
+	assert.Nil(t, i)
+	assert.False(t, isFirst)
+
+	i, isFirst = tracker.take("event-1", "other")
+	assert.Nil(t, i)
+	assert.False(t, isFirst)
+
+	// The first reply to each interaction is the response, then any more are
+	// follow-ups.
+	i, isFirst = tracker.take("event-2", "chan")
+	assert.Equal(t, second, i)
+	assert.True(t, isFirst)
+
+	i, isFirst = tracker.take("event-2", "chan")
+	assert.Equal(t, second, i)
+	assert.False(t, isFirst)
+
+	assert.True(t, <-expired)
+	assert.False(t, tracker.has("event-2"))
+
+	i, _ = tracker.take("event-2", "chan")
+	assert.Nil(t, i)
+
+	assert.True(t, tracker.has("event-1"))
+	i, isFirst = tracker.take("event-1", "chan")
+	assert.Equal(t, first, i)
+	assert.True(t, isFirst)
+}
+
+func TestInteractionTrackerClaim(t *testing.T) {
+	tracker := newInteractionTracker()
+
+	tracker.add("event-1", &discordgo.Interaction{ID: "1", ChannelID: "chan"}, time.Hour, func(bool) {})
+	tracker.add("event-2", &discordgo.Interaction{ID: "2", ChannelID: "chan"}, time.Hour, func(bool) {})
+	tracker.add("event-3", &discordgo.Interaction{ID: "3", ChannelID: "chan"}, time.Hour, func(bool) {})
+	tracker.add("event-4", &discordgo.Interaction{ID: "4", ChannelID: "other"}, time.Hour, func(bool) {})
+
+	// Interactions which already have a reply can't be claimed.
+	tracker.take("event-1", "chan")
+
+	// The oldest interaction in the channel is claimed first, and each one
+	// can only be claimed once.
+	eventID, ok := tracker.claim("chan")
+	assert.True(t, ok)
+	assert.Equal(t, "event-2", eventID)
+
+	eventID, ok = tracker.claim("chan")
+	assert.True(t, ok)
+	assert.Equal(t, "event-3", eventID)
+
+	_, ok = tracker.claim("chan")
+	assert.False(t, ok)
+
+	eventID, ok = tracker.claim("other")
+	assert.True(t, ok)
+	assert.Equal(t, "event-4", eventID)
+}
+
+func TestBackendSlashCommand(t *testing.T) {
+	config := DefaultConfig()
+	config.SlashCommands = true
+	config.SlashCommandNames = []string{"weather"}
+
+	b, fake := newTestBackend(t, config)
+
+	// Commands belong to the application rather than the bot user.
+	req, err := fake.WaitForRequest("PUT", "/applications/{app}/commands", time.Second)
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v9/applications/"+fake.ApplicationID+"/commands", req.Path)
+
+	var commands []*discordgo.ApplicationCommand
+	require.NoError(t, req.Decode(&commands))
+	require.Len(t, commands, 1)
+	assert.Equal(t, "weather", commands[0].Name)
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+	require.NoError(t, fake.Dispatch("INTERACTION_CREATE", &discordgo.Interaction{
+		ID:        "500",
+		AppID:     fake.ApplicationID,
+		Type:      discordgo.InteractionApplicationCommand,
+		ChannelID: "10",
+		GuildID:   "1",
+		Member:    &discordgo.Member{User: testUser},
+		Token:     "interaction-token",
+		Data: discordgo.ApplicationCommandInteractionData{
+			ID:   "600",
+			Name: "weather",
+			Options: []*discordgo.ApplicationCommandInteractionDataOption{
+				{Name: slashCommandArgOption, Type: discordgo.ApplicationCommandOptionString, Value: "seattle"},
+			},
+		},
+	}))
+
+	e := nextEvent(t, b)
+	require.IsType(t, &pb.ChatEvent_Command{}, e.Inner)
+	assert.NotEmpty(t, e.Id)
+	assert.Equal(t, "weather", e.GetCommand().Command)
+	assert.Equal(t, "seattle", e.GetCommand().Arg)
+	assert.Equal(t, "2", e.GetCommand().Source.User.Id)
+
+	_, err = fake.WaitForRequest("POST", "/interactions/500/interaction-token/callback", time.Second)
+	require.NoError(t, err)
+
+	// Most plugins reply without any tags, so the first untagged message to
+	// the channel is the response.
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "sunny"}))
+
+	req, err = fake.WaitForRequest("PATCH", "/webhooks/"+fake.ApplicationID+"/interaction-token/messages/@original", time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, string(req.Body), "sunny")
+
+	// Once the command has a response, untagged messages are sent as normal.
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "unrelated"}))
+
+	req, err = fake.WaitForRequest("POST", "/channels/10/messages", time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, string(req.Body), "unrelated")
+
+	// Tagged replies after the response are sent as follow-ups.
+	tags := map[string]string{TagReplyTo: e.Id}
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "and warm", Tags: tags}))
+
+	req, err = fake.WaitForRequest("POST", "/webhooks/"+fake.ApplicationID+"/interaction-token", time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, string(req.Body), "and warm")
+
+	// A tagged reply answers its own command, even if an older one in the
+	// channel is still waiting.
+	interact := func(id, token string) *pb.ChatEvent {
+		require.NoError(t, fake.Dispatch("INTERACTION_CREATE", &discordgo.Interaction{
+			ID:        id,
+			AppID:     fake.ApplicationID,
+			Type:      discordgo.InteractionApplicationCommand,
+			ChannelID: "10",
+			GuildID:   "1",
+			Member:    &discordgo.Member{User: testUser},
+			Token:     token,
+			Data:      discordgo.ApplicationCommandInteractionData{ID: "600", Name: "weather"},
+		}))
+
+		return nextEvent(t, b)
+	}
+
+	interact("501", "token-1")
+	second := interact("502", "token-2")
+
+	tags = map[string]string{TagReplyTo: second.Id}
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "cloudy", Tags: tags}))
+
+	req, err = fake.WaitForRequest("PATCH", "/webhooks/"+fake.ApplicationID+"/token-2/messages/@original", time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, string(req.Body), "cloudy")
+
+	require.NoError(t, b.deliverMessage(&outboundMessage{ChannelID: "10", Text: "rainy"}))
+
+	req, err = fake.WaitForRequest("PATCH", "/webhooks/"+fake.ApplicationID+"/token-1/messages/@original", time.Second)
+	require.NoError(t, err)
+	assert.Contains(t, string(req.Body), "rainy")
+
+	var channelMessages int
+	for _, req := range fake.Requests() {
+		if req.Method == "POST" && req.Path == "/api/v9/channels/10/messages" {
+			channelMessages++
+		}
+	}
+	assert.Equal(t, 1, channelMessages)
+}
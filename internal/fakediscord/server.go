@@ -0,0 +1,617 @@
+// Package fakediscord implements just enough of the Discord gateway and REST
+// API to run a discordgo session against in tests.
+//
+// REST requests are recorded so tests can assert on them, and gateway events
+// can be sent to the connected session with Dispatch.
+package fakediscord
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gorilla/websocket"
+)
+
+// gatewayPath is where the gateway websocket is served.
+const gatewayPath = "/gateway"
+
+// heartbeatInterval is sent in the Hello packet. It's long enough that
+// heartbeats don't get in the way of tests.
+const heartbeatInterval = 45000
+
+// Request is a REST request received by the server.
+type Request struct {
+	Method string
+	Path   string
+	Query  url.Values
+	Body   []byte
+}
+
+// Decode unmarshals the request body.
+func (r Request) Decode(v interface{}) error {
+	return json.Unmarshal(r.Body, v)
+}
+
+// HandlerFunc responds to a REST request. Params contains the values of any
+// {name} segments in the route's pattern. The returned value is encoded as
+// JSON. If an error is returned, it is sent as a 500 error, unless it's an
+// *Error.
+type HandlerFunc func(req Request, params map[string]string) (interface{}, error)
+
+// Error can be returned by a HandlerFunc to send a Discord API error.
+type Error struct {
+	Status  int
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%d: %s", e.Status, e.Message)
+}
+
+type route struct {
+	method  string
+	pattern []string
+	handler HandlerFunc
+}
+
+// Server is a fake Discord server. It must be closed when the test is done.
+type Server struct {
+	// BotUser is sent in the READY event, so it is the user the session is
+	// logged in as.
+	BotUser *discordgo.User
+
+	// ApplicationID is sent in the READY event. Interaction responses and
+	// follow-ups are sent through a webhook with this ID.
+	ApplicationID string
+
+	server   *httptest.Server
+	upgrader websocket.Upgrader
+
+	lock     sync.Mutex
+	routes   []route
+	requests []Request
+	notify   chan struct{}
+	nextID   uint64
+	webhooks map[string]*discordgo.Webhook
+
+	connLock sync.Mutex
+	conn     *websocket.Conn
+	sequence int64
+}
+
+// New starts a new fake Discord server.
+func New() *Server {
+	s := &Server{
+		BotUser: &discordgo.User{
+			ID:       "1000",
+			Username: "seabird",
+			Bot:      true,
+		},
+		ApplicationID: "2000",
+		notify:        make(chan struct{}),
+		nextID:        1000000,
+		webhooks:      make(map[string]*discordgo.Webhook),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(gatewayPath, s.handleGateway)
+	mux.HandleFunc(gatewayPath+"/", s.handleGateway)
+	mux.HandleFunc("/", s.handleREST)
+	s.server = httptest.NewServer(mux)
+
+	s.Handle("GET", "/gateway", s.handleGetGateway)
+	s.Handle("GET", "/gateway/bot", s.handleGetGateway)
+	s.Handle("POST", "/channels/{channel}/messages", s.handleSendMessage)
+	s.Handle("PATCH", "/channels/{channel}", s.handleEditChannel)
+	s.Handle("POST", "/users/@me/channels", s.handleCreateDM)
+	s.Handle("PUT", "/applications/{app}/commands", s.handleEcho)
+	s.Handle("GET", "/channels/{channel}/webhooks", s.handleListWebhooks)
+	s.Handle("POST", "/channels/{channel}/webhooks", s.handleCreateWebhook)
+	s.Handle("GET", "/webhooks/{webhook}", s.handleGetWebhook)
+	s.Handle("POST", "/webhooks/{webhook}/{token}", s.handleExecuteWebhook)
+	s.Handle("POST", "/interactions/{interaction}/{token}/callback", s.handleNoContent)
+	s.Handle("PATCH", "/webhooks/{webhook}/{token}/messages/@original", s.handleEditOriginal)
+	s.Handle("DELETE", "/webhooks/{webhook}/{token}/messages/@original", s.handleNoContent)
+
+	return s
+}
+
+// Close shuts down the server, disconnecting any session.
+func (s *Server) Close() {
+	s.Disconnect()
+	s.server.Close()
+}
+
+// Transport returns a RoundTripper which sends all requests to this server,
+// no matter which host they were meant for. It should be used as the
+// transport of the session's HTTP client.
+func (s *Server) Transport() http.RoundTripper {
+	target, _ := url.Parse(s.server.URL)
+
+	return roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+		req = req.Clone(req.Context())
+		req.URL.Scheme = target.Scheme
+		req.URL.Host = target.Host
+		req.Host = target.Host
+		return http.DefaultTransport.RoundTrip(req)
+	})
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+// NewID returns a new unique snowflake.
+func (s *Server) NewID() string {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.nextID++
+	return strconv.FormatUint(s.nextID, 10)
+}
+
+// Handle adds a handler for a REST route. Pattern is relative to the API root,
+// like "/channels/{channel}/messages". Routes added later take priority, so
+// this can be used to override the default handlers.
+func (s *Server) Handle(method, pattern string, handler HandlerFunc) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.routes = append(s.routes, route{
+		method:  method,
+		pattern: strings.Split(strings.Trim(pattern, "/"), "/"),
+		handler: handler,
+	})
+}
+
+// Requests returns all REST requests received so far.
+func (s *Server) Requests() []Request {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// WaitForRequest waits for a REST request matching the method and pattern,
+// including any which have already been received, and returns the first one.
+func (s *Server) WaitForRequest(method, pattern string, timeout time.Duration) (Request, error) {
+	parts := strings.Split(strings.Trim(pattern, "/"), "/")
+	deadline := time.After(timeout)
+
+	for {
+		s.lock.Lock()
+		for _, req := range s.requests {
+			if _, ok := matchRoute(parts, apiPath(req.Path)); ok && req.Method == method {
+				s.lock.Unlock()
+				return req, nil
+			}
+		}
+		notify := s.notify
+		s.lock.Unlock()
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return Request{}, fmt.Errorf("timed out waiting for %s %s", method, pattern)
+		}
+	}
+}
+
+// apiPath strips the API prefix from a request path.
+func apiPath(path string) string {
+	return strings.TrimPrefix(path, "/api/v"+discordgo.APIVersion)
+}
+
+// matchRoute checks if a path matches a pattern, returning any params.
+func matchRoute(pattern []string, path string) (map[string]string, bool) {
+	parts := strings.Split(strings.Trim(path, "/"), "/")
+	if len(parts) != len(pattern) {
+		return nil, false
+	}
+
+	params := make(map[string]string)
+	for i, part := range pattern {
+		if strings.HasPrefix(part, "{") && strings.HasSuffix(part, "}") {
+			params[strings.Trim(part, "{}")] = parts[i]
+		} else if part != parts[i] {
+			return nil, false
+		}
+	}
+
+	return params, true
+}
+
+func (s *Server) handleREST(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	req := Request{Method: r.Method, Path: r.URL.Path, Query: r.URL.Query(), Body: body}
+
+	s.lock.Lock()
+	s.requests = append(s.requests, req)
+	close(s.notify)
+	s.notify = make(chan struct{})
+
+	var handler HandlerFunc
+	var params map[string]string
+	for i := len(s.routes) - 1; i >= 0; i-- {
+		route := s.routes[i]
+		if route.method != r.Method {
+			continue
+		}
+		if p, ok := matchRoute(route.pattern, apiPath(r.URL.Path)); ok {
+			handler, params = route.handler, p
+			break
+		}
+	}
+	s.lock.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if handler == nil {
+		w.WriteHeader(http.StatusNotFound)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"code": 0, "message": "404: Not Found"})
+		return
+	}
+
+	resp, err := handler(req, params)
+	if err != nil {
+		apiErr := &Error{Status: http.StatusInternalServerError, Message: err.Error()}
+		errors.As(err, &apiErr)
+
+		w.WriteHeader(apiErr.Status)
+		_ = json.NewEncoder(w).Encode(map[string]interface{}{"code": apiErr.Code, "message": apiErr.Message})
+		return
+	}
+
+	if resp == nil {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+func (s *Server) handleGetGateway(req Request, params map[string]string) (interface{}, error) {
+	return map[string]interface{}{
+		"url":    "ws" + strings.TrimPrefix(s.server.URL, "http") + gatewayPath,
+		"shards": 1,
+	}, nil
+}
+
+func (s *Server) handleSendMessage(req Request, params map[string]string) (interface{}, error) {
+	var data discordgo.MessageSend
+	if err := req.Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return &discordgo.Message{
+		ID:               s.NewID(),
+		ChannelID:        params["channel"],
+		Content:          data.Content,
+		Author:           s.BotUser,
+		MessageReference: data.Reference,
+	}, nil
+}
+
+func (s *Server) handleEditChannel(req Request, params map[string]string) (interface{}, error) {
+	var data map[string]interface{}
+	if err := req.Decode(&data); err != nil {
+		return nil, err
+	}
+
+	data["id"] = params["channel"]
+	return data, nil
+}
+
+func (s *Server) handleCreateDM(req Request, params map[string]string) (interface{}, error) {
+	var data struct {
+		RecipientID string `json:"recipient_id"`
+	}
+	if err := req.Decode(&data); err != nil {
+		return nil, err
+	}
+
+	return &discordgo.Channel{
+		ID:         s.NewID(),
+		Type:       discordgo.ChannelTypeDM,
+		Recipients: []*discordgo.User{{ID: data.RecipientID}},
+	}, nil
+}
+
+// Webhooks returns the webhooks which have been created in a channel.
+func (s *Server) Webhooks(channelID string) []*discordgo.Webhook {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	var ret []*discordgo.Webhook
+	for _, webhook := range s.webhooks {
+		if webhook.ChannelID == channelID {
+			ret = append(ret, webhook)
+		}
+	}
+
+	return ret
+}
+
+// DeleteWebhook deletes a webhook, as if it was removed by a user.
+func (s *Server) DeleteWebhook(webhookID string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.webhooks, webhookID)
+}
+
+func (s *Server) handleListWebhooks(req Request, params map[string]string) (interface{}, error) {
+	webhooks := s.Webhooks(params["channel"])
+	if webhooks == nil {
+		webhooks = []*discordgo.Webhook{}
+	}
+
+	return webhooks, nil
+}
+
+func (s *Server) handleCreateWebhook(req Request, params map[string]string) (interface{}, error) {
+	var data struct {
+		Name string `json:"name"`
+	}
+	if err := req.Decode(&data); err != nil {
+		return nil, err
+	}
+
+	webhook := &discordgo.Webhook{
+		ID:        s.NewID(),
+		Type:      discordgo.WebhookTypeIncoming,
+		ChannelID: params["channel"],
+		User:      s.BotUser,
+		Name:      data.Name,
+		Token:     "token-" + s.NewID(),
+	}
+
+	s.lock.Lock()
+	s.webhooks[webhook.ID] = webhook
+	s.lock.Unlock()
+
+	return webhook, nil
+}
+
+func (s *Server) handleGetWebhook(req Request, params map[string]string) (interface{}, error) {
+	s.lock.Lock()
+	webhook, ok := s.webhooks[params["webhook"]]
+	s.lock.Unlock()
+
+	if !ok {
+		return nil, &Error{Status: http.StatusNotFound, Code: discordgo.ErrCodeUnknownWebhook, Message: "Unknown Webhook"}
+	}
+
+	return webhook, nil
+}
+
+func (s *Server) handleExecuteWebhook(req Request, params map[string]string) (interface{}, error) {
+	// Interaction follow-ups go through the application's webhook, which
+	// accepts any interaction token.
+	if params["webhook"] == s.ApplicationID {
+		var data discordgo.WebhookParams
+		if err := req.Decode(&data); err != nil {
+			return nil, err
+		}
+
+		return &discordgo.Message{
+			ID:      s.NewID(),
+			Content: data.Content,
+			Author:  s.BotUser,
+		}, nil
+	}
+
+	s.lock.Lock()
+	webhook, ok := s.webhooks[params["webhook"]]
+	s.lock.Unlock()
+
+	if !ok || webhook.Token != params["token"] {
+		return nil, &Error{Status: http.StatusNotFound, Code: discordgo.ErrCodeUnknownWebhook, Message: "Unknown Webhook"}
+	}
+
+	var data discordgo.WebhookParams
+	if err := req.Decode(&data); err != nil {
+		return nil, err
+	}
+
+	channelID := webhook.ChannelID
+	if threadID := req.Query.Get("thread_id"); threadID != "" {
+		channelID = threadID
+	}
+
+	username := data.Username
+	if username == "" {
+		username = webhook.Name
+	}
+
+	return &discordgo.Message{
+		ID:        s.NewID(),
+		ChannelID: channelID,
+		Content:   data.Content,
+		WebhookID: webhook.ID,
+		Author:    &discordgo.User{ID: webhook.ID, Username: username, Bot: true},
+	}, nil
+}
+
+func (s *Server) handleEditOriginal(req Request, params map[string]string) (interface{}, error) {
+	var data discordgo.WebhookEdit
+	if err := req.Decode(&data); err != nil {
+		return nil, err
+	}
+
+	msg := &discordgo.Message{ID: s.NewID(), Author: s.BotUser}
+	if data.Content != nil {
+		msg.Content = *data.Content
+	}
+
+	return msg, nil
+}
+
+// handleNoContent responds with an empty body.
+func (s *Server) handleNoContent(req Request, params map[string]string) (interface{}, error) {
+	return nil, nil
+}
+
+// handleEcho responds with the request body.
+func (s *Server) handleEcho(req Request, params map[string]string) (interface{}, error) {
+	return json.RawMessage(req.Body), nil
+}
+
+// gatewayPayload is a single message on the gateway.
+type gatewayPayload struct {
+	Op       int             `json:"op"`
+	Data     json.RawMessage `json:"d"`
+	Sequence int64           `json:"s,omitempty"`
+	Type     string          `json:"t,omitempty"`
+}
+
+func (s *Server) handleGateway(w http.ResponseWriter, r *http.Request) {
+	conn, err := s.upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	// Only one session can be connected at a time, so we kick off any
+	// existing one.
+	s.Disconnect()
+
+	err = conn.WriteJSON(map[string]interface{}{
+		"op": 10,
+		"d":  map[string]interface{}{"heartbeat_interval": heartbeatInterval},
+	})
+	if err != nil {
+		return
+	}
+
+	// The session either identifies or resumes, and both are answered by
+	// becoming ready.
+	var identify gatewayPayload
+	if err := conn.ReadJSON(&identify); err != nil {
+		return
+	}
+
+	s.connLock.Lock()
+	s.conn = conn
+	s.connLock.Unlock()
+
+	if identify.Op == 6 {
+		err = s.Dispatch("RESUMED", map[string]interface{}{})
+	} else {
+		err = s.Dispatch("READY", map[string]interface{}{
+			"v":          9,
+			"session_id": "fake-session",
+			"user":       s.BotUser,
+			"application": map[string]interface{}{
+				"id": s.ApplicationID,
+			},
+			"guilds": []interface{}{},
+		})
+	}
+	if err != nil {
+		return
+	}
+
+	for {
+		var payload gatewayPayload
+		if err := conn.ReadJSON(&payload); err != nil {
+			return
+		}
+
+		// Heartbeats need an ack or the session will reconnect.
+		if payload.Op == 1 {
+			if err := s.write(conn, map[string]interface{}{"op": 11}); err != nil {
+				return
+			}
+		}
+	}
+}
+
+func (s *Server) write(conn *websocket.Conn, v interface{}) error {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	return conn.WriteJSON(v)
+}
+
+// ErrNotConnected is returned by Dispatch if no session is connected.
+var ErrNotConnected = errors.New("no session is connected")
+
+// Dispatch sends an event, such as "MESSAGE_CREATE", to the connected
+// session. Data is encoded as JSON, so it can be a discordgo type.
+func (s *Server) Dispatch(eventType string, data interface{}) error {
+	raw, err := json.Marshal(data)
+	if err != nil {
+		return err
+	}
+
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.conn == nil {
+		return ErrNotConnected
+	}
+
+	s.sequence++
+
+	return s.conn.WriteJSON(gatewayPayload{
+		Op:       0,
+		Data:     raw,
+		Sequence: s.sequence,
+		Type:     eventType,
+	})
+}
+
+// WaitForSession waits until a session has connected to the gateway.
+func (s *Server) WaitForSession(timeout time.Duration) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	deadline := time.After(timeout)
+
+	for {
+		s.connLock.Lock()
+		connected := s.conn != nil
+		s.connLock.Unlock()
+
+		if connected {
+			return nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return ErrNotConnected
+		}
+	}
+}
+
+// Disconnect closes the gateway connection, if there is one. The session will
+// try to reconnect.
+func (s *Server) Disconnect() {
+	s.connLock.Lock()
+	defer s.connLock.Unlock()
+
+	if s.conn != nil {
+		s.conn.Close()
+		s.conn = nil
+	}
+}
@@ -0,0 +1,333 @@
+// Package fakeseabird implements an in-memory seabird-core for tests. It
+// serves the ChatIngest service backends connect to, along with the parts of
+// the Seabird service the Discord backend uses.
+package fakeseabird
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+
+	"github.com/seabird-chat/seabird-go/pb"
+)
+
+// ErrNotConnected is returned by SendRequest if no backend is connected.
+var ErrNotConnected = errors.New("no backend is connected")
+
+// stream is a single connection to the ChatIngest service.
+type stream struct {
+	requests chan *pb.ChatRequest
+	drop     chan struct{}
+}
+
+// Server is a fake seabird-core. It must be closed when the test is done.
+type Server struct {
+	pb.UnimplementedChatIngestServer
+	pb.UnimplementedSeabirdServer
+
+	listener net.Listener
+	grpc     *grpc.Server
+
+	lock        sync.Mutex
+	notify      chan struct{}
+	events      []*pb.ChatEvent
+	messages    []*pb.SendMessageRequest
+	commands    map[string]*pb.CommandMetadata
+	current     *stream
+	connections int
+	attempts    int
+	reject      error
+}
+
+// New starts a new fake seabird-core listening on a random local port.
+func New() (*Server, error) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+
+	s := &Server{
+		listener: listener,
+		grpc:     grpc.NewServer(),
+		notify:   make(chan struct{}),
+		commands: make(map[string]*pb.CommandMetadata),
+	}
+
+	pb.RegisterChatIngestServer(s.grpc, s)
+	pb.RegisterSeabirdServer(s.grpc, s)
+
+	go func() { _ = s.grpc.Serve(listener) }()
+
+	return s, nil
+}
+
+// URL returns the URL to use as the seabird-core host.
+func (s *Server) URL() string {
+	return "http://" + s.listener.Addr().String()
+}
+
+// Close stops the server, ending any open streams.
+func (s *Server) Close() {
+	s.grpc.Stop()
+}
+
+// changed wakes anything waiting on the server. The lock must be held.
+func (s *Server) changed() {
+	close(s.notify)
+	s.notify = make(chan struct{})
+}
+
+// wait calls check until it returns true or the timeout passes. Check is
+// called with the lock held.
+func (s *Server) wait(timeout time.Duration, check func() bool) bool {
+	deadline := time.After(timeout)
+
+	for {
+		s.lock.Lock()
+		if check() {
+			s.lock.Unlock()
+			return true
+		}
+		notify := s.notify
+		s.lock.Unlock()
+
+		select {
+		case <-notify:
+		case <-deadline:
+			return false
+		}
+	}
+}
+
+// IngestEvents handles a connection from a backend. The first event must be a
+// hello. Only one backend can be connected at a time, so a new connection
+// replaces any existing one.
+func (s *Server) IngestEvents(srv pb.ChatIngest_IngestEventsServer) error {
+	hello, err := srv.Recv()
+	if err != nil {
+		return err
+	}
+	if hello.GetHello() == nil {
+		return status.Error(codes.InvalidArgument, "first event must be a hello")
+	}
+
+	s.lock.Lock()
+	s.attempts++
+	reject := s.reject
+	s.changed()
+	s.lock.Unlock()
+
+	if reject != nil {
+		return reject
+	}
+
+	current := &stream{
+		requests: make(chan *pb.ChatRequest),
+		drop:     make(chan struct{}),
+	}
+
+	s.lock.Lock()
+	s.events = append(s.events, hello)
+	s.current = current
+	s.connections++
+	s.changed()
+	s.lock.Unlock()
+
+	defer func() {
+		s.lock.Lock()
+		if s.current == current {
+			s.current = nil
+		}
+		s.changed()
+		s.lock.Unlock()
+	}()
+
+	recvErr := make(chan error, 1)
+	go func() {
+		for {
+			event, err := srv.Recv()
+			if err != nil {
+				recvErr <- err
+				return
+			}
+
+			s.lock.Lock()
+			s.events = append(s.events, event)
+			s.changed()
+			s.lock.Unlock()
+		}
+	}()
+
+	for {
+		select {
+		case req := <-current.requests:
+			if err := srv.Send(req); err != nil {
+				return err
+			}
+		case <-current.drop:
+			return status.Error(codes.Unavailable, "stream dropped")
+		case err := <-recvErr:
+			return err
+		case <-srv.Context().Done():
+			return srv.Context().Err()
+		}
+	}
+}
+
+// SendRequest sends a request to the connected backend.
+func (s *Server) SendRequest(req *pb.ChatRequest) error {
+	s.lock.Lock()
+	current := s.current
+	s.lock.Unlock()
+
+	if current == nil {
+		return ErrNotConnected
+	}
+
+	select {
+	case current.requests <- req:
+		return nil
+	case <-current.drop:
+		return ErrNotConnected
+	}
+}
+
+// DropStream ends the current stream with an error, as if seabird-core had
+// gone away. The backend is expected to reconnect.
+func (s *Server) DropStream() {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.current != nil {
+		close(s.current.drop)
+		s.current = nil
+		s.changed()
+	}
+}
+
+// Reject makes the server end every new stream with err as soon as the hello
+// has been received, like seabird-core does when the token is invalid. Passing
+// nil accepts streams again.
+func (s *Server) Reject(err error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.reject = err
+}
+
+// Attempts returns how many streams a backend has opened, including any which
+// were rejected.
+func (s *Server) Attempts() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.attempts
+}
+
+// WaitForAttempts waits until a backend has opened at least count streams,
+// including any which were rejected.
+func (s *Server) WaitForAttempts(count int, timeout time.Duration) error {
+	ok := s.wait(timeout, func() bool {
+		return s.attempts >= count
+	})
+	if !ok {
+		return fmt.Errorf("timed out waiting for attempt %d", count)
+	}
+
+	return nil
+}
+
+// Connections returns how many times a backend has connected.
+func (s *Server) Connections() int {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.connections
+}
+
+// WaitForConnection waits until a backend has connected at least count times
+// and is currently connected.
+func (s *Server) WaitForConnection(count int, timeout time.Duration) error {
+	ok := s.wait(timeout, func() bool {
+		return s.connections >= count && s.current != nil
+	})
+	if !ok {
+		return fmt.Errorf("timed out waiting for connection %d", count)
+	}
+
+	return nil
+}
+
+// Events returns a copy of every event received so far, in order.
+func (s *Server) Events() []*pb.ChatEvent {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	ret := make([]*pb.ChatEvent, len(s.events))
+	for i, event := range s.events {
+		ret[i] = proto.Clone(event).(*pb.ChatEvent)
+	}
+
+	return ret
+}
+
+// WaitForEvent waits for an event matching the filter, including any which
+// have already been received, and returns the first one.
+func (s *Server) WaitForEvent(match func(*pb.ChatEvent) bool, timeout time.Duration) (*pb.ChatEvent, error) {
+	var ret *pb.ChatEvent
+	ok := s.wait(timeout, func() bool {
+		for _, event := range s.events {
+			if match(event) {
+				ret = proto.Clone(event).(*pb.ChatEvent)
+				return true
+			}
+		}
+		return false
+	})
+	if !ok {
+		return nil, errors.New("timed out waiting for event")
+	}
+
+	return ret, nil
+}
+
+// SetCommands sets the commands returned by RegisteredCommands.
+func (s *Server) SetCommands(commands map[string]*pb.CommandMetadata) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.commands = commands
+}
+
+// Messages returns every message sent with the Seabird service, in order.
+func (s *Server) Messages() []*pb.SendMessageRequest {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return append([]*pb.SendMessageRequest(nil), s.messages...)
+}
+
+func (s *Server) SendMessage(ctx context.Context, req *pb.SendMessageRequest) (*pb.SendMessageResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.messages = append(s.messages, req)
+	s.changed()
+
+	return &pb.SendMessageResponse{}, nil
+}
+
+func (s *Server) RegisteredCommands(ctx context.Context, req *pb.CommandsRequest) (*pb.CommandsResponse, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return &pb.CommandsResponse{Commands: s.commands}, nil
+}
@@ -0,0 +1,214 @@
+package seabird_discord
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+
+	"github.com/seabird-chat/seabird-go/pb"
+)
+
+// listenState tracks which channels seabird has asked us to leave. This is a
+// deny-list rather than an allow-list: every channel the bot can see is
+// listened to by default, including new ones, so only muted channels are
+// stored. If a path is provided, the state is persisted so it survives a
+// restart.
+type listenState struct {
+	lock  sync.RWMutex
+	path  string
+	muted map[string]bool
+}
+
+type listenStateFile struct {
+	Muted []string `json:"muted"`
+}
+
+func newListenState(path string) (*listenState, error) {
+	s := &listenState{
+		path:  path,
+		muted: make(map[string]bool),
+	}
+
+	if path == "" {
+		return s, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	} else if err != nil {
+		return nil, fmt.Errorf("failed to read channel state: %w", err)
+	}
+
+	var file listenStateFile
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse channel state: %w", err)
+	}
+
+	for _, channelID := range file.Muted {
+		s.muted[channelID] = true
+	}
+
+	return s, nil
+}
+
+// IsListening returns true if events from the given channel should be sent to
+// seabird.
+func (s *listenState) IsListening(channelID string) bool {
+	s.lock.RLock()
+	defer s.lock.RUnlock()
+
+	return !s.muted[channelID]
+}
+
+// SetListening updates the state for a channel. It returns true if the state
+// changed.
+func (s *listenState) SetListening(channelID string, listening bool) (bool, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.muted[channelID] == !listening {
+		return false, nil
+	}
+
+	if listening {
+		delete(s.muted, channelID)
+	} else {
+		s.muted[channelID] = true
+	}
+
+	return true, s.save()
+}
+
+func (s *listenState) save() error {
+	if s.path == "" {
+		return nil
+	}
+
+	file := listenStateFile{Muted: []string{}}
+	for channelID := range s.muted {
+		file.Muted = append(file.Muted, channelID)
+	}
+	sort.Strings(file.Muted)
+
+	data, err := json.MarshalIndent(file, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash can't leave us with a
+	// partially written state file.
+	tmp, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return fmt.Errorf("failed to write channel state: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	_, err = tmp.Write(data)
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("failed to write channel state: %w", err)
+	}
+
+	err = os.Rename(tmp.Name(), s.path)
+	if err != nil {
+		return fmt.Errorf("failed to write channel state: %w", err)
+	}
+
+	return nil
+}
+
+// resolveChannel looks up a message channel by ID or by name. Names are only
+// accepted if they are unique across all guilds.
+func (b *Backend) resolveChannel(name string) (*discordgo.Channel, error) {
+	name = strings.TrimPrefix(name, "#")
+
+	if c, err := b.session.State().Channel(name); err == nil {
+		return c, checkMessageChannel(c)
+	}
+
+	b.session.State().RLock()
+	defer b.session.State().RUnlock()
+
+	var found []*discordgo.Channel
+	for _, g := range b.session.State().Guilds {
+		for _, c := range g.Channels {
+			if isMessageChannel(c) && c.Name == name {
+				found = append(found, c)
+			}
+		}
+	}
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("unknown channel %q", name)
+	case 1:
+		return found[0], nil
+	default:
+		return nil, fmt.Errorf("channel name %q is ambiguous, use the channel ID instead", name)
+	}
+}
+
+// checkMessageChannel returns an error if c isn't a guild channel we could be
+// listening to.
+func checkMessageChannel(c *discordgo.Channel) error {
+	if c.GuildID == "" || !isMessageChannel(c) {
+		return fmt.Errorf("channel %q is not a text channel or thread", c.ID)
+	}
+
+	return nil
+}
+
+func (b *Backend) joinChannel(name string) error {
+	c, err := b.resolveChannel(name)
+	if err != nil {
+		return err
+	}
+
+	changed, err := b.listening.SetListening(c.ID, true)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		b.writeJoinChannel(c)
+	}
+
+	return nil
+}
+
+// leaveChannel mutes a channel. Only channels we could be listening to can be
+// left, so a typo doesn't silently add an unknown ID to the state.
+func (b *Backend) leaveChannel(channelID string) error {
+	c, err := b.session.State().Channel(channelID)
+	if err != nil {
+		return fmt.Errorf("unknown channel %q", channelID)
+	}
+
+	if err := checkMessageChannel(c); err != nil {
+		return err
+	}
+
+	changed, err := b.listening.SetListening(channelID, false)
+	if err != nil {
+		return err
+	}
+
+	if changed {
+		b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_LeaveChannel{LeaveChannel: &pb.LeaveChannelChatEvent{
+			ChannelId: channelID,
+		}}})
+	}
+
+	return nil
+}
@@ -0,0 +1,47 @@
+package seabird_discord
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenState(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "channels.json")
+
+	s, err := newListenState(path)
+	require.NoError(t, err)
+
+	// Everything is listened to by default.
+	assert.True(t, s.IsListening("a"))
+
+	changed, err := s.SetListening("a", false)
+	require.NoError(t, err)
+	assert.True(t, changed)
+	assert.False(t, s.IsListening("a"))
+
+	changed, err = s.SetListening("a", false)
+	require.NoError(t, err)
+	assert.False(t, changed)
+
+	_, err = s.SetListening("b", false)
+	require.NoError(t, err)
+
+	// The state should be loaded when restarting.
+	s, err = newListenState(path)
+	require.NoError(t, err)
+	assert.False(t, s.IsListening("a"))
+	assert.False(t, s.IsListening("b"))
+	assert.True(t, s.IsListening("c"))
+
+	changed, err = s.SetListening("a", true)
+	require.NoError(t, err)
+	assert.True(t, changed)
+
+	s, err = newListenState(path)
+	require.NoError(t, err)
+	assert.True(t, s.IsListening("a"))
+	assert.False(t, s.IsListening("b"))
+}
@@ -0,0 +1,42 @@
+package seabird_discord
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestLRUCache(t *testing.T) {
+	c := newLRUCache[string, int](2)
+
+	c.Add("a", 1)
+	c.Add("b", 2)
+	assert.Equal(t, 2, c.Len())
+
+	// Looking up a marks it as recently used, so b should be evicted next.
+	v, ok := c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 1, v)
+
+	c.Add("c", 3)
+	assert.Equal(t, 2, c.Len())
+
+	_, ok = c.Get("b")
+	assert.False(t, ok)
+
+	// Updating an existing key shouldn't evict anything.
+	c.Add("a", 4)
+	assert.Equal(t, 2, c.Len())
+
+	v, ok = c.Get("a")
+	assert.True(t, ok)
+	assert.Equal(t, 4, v)
+
+	v, ok = c.Get("c")
+	assert.True(t, ok)
+	assert.Equal(t, 3, v)
+
+	c.Add("d", 5)
+	_, ok = c.Get("a")
+	assert.False(t, ok)
+}
@@ -68,10 +68,10 @@ func TextToBlock(data string) (*pb.Block, bool, error) {
 
 			// NOTE: underline must be a higher priority than the emphasis
 			// parser to work correctly.
-			util.Prioritized(newMultiCharInlineParser('_', "Underline"), 450),
+			util.Prioritized(newMultiCharInlineParser('_', kindUnderline), 450),
 
-			util.Prioritized(newMultiCharInlineParser('|', "Spoiler"), 1000),
-			util.Prioritized(newMultiCharInlineParser('~', "Strikethrough"), 1000),
+			util.Prioritized(newMultiCharInlineParser('|', kindSpoiler), 1000),
+			util.Prioritized(newMultiCharInlineParser('~', kindStrikethrough), 1000),
 
 			// We want to convert automatically linkified URLs to a format which
 			// seabird understands, just in case. It's better for
@@ -124,7 +124,17 @@ func nodeToBlocks(doc ast.Node, src []byte) ([]*pb.Block, error) {
 			}
 			ret = append(ret, maybeContainer(nodes...))
 		case *ast.Text:
-			ret = append(ret, seabird.NewTextBlock(string(node.Value(src))))
+			// Goldmark leaves backslash escapes in the source text, so we need
+			// to remove them to get what the user actually sees.
+			value := string(util.UnescapePunctuations(node.Value(src)))
+
+			// Discord displays all newlines, so we need to keep line breaks
+			// rather than joining the lines together.
+			if node.SoftLineBreak() || node.HardLineBreak() {
+				value += "\n"
+			}
+
+			ret = append(ret, seabird.NewTextBlock(value))
 		case *ast.String:
 			ret = append(ret, seabird.NewTextBlock(string(node.Value)))
 		case *ast.AutoLink:
@@ -265,6 +275,16 @@ func scanMultiCharDelimiter(line []byte, targetLen int, processor parser.Delimit
 	return parser.NewDelimiter(true, true, targetLen, c, processor)
 }
 
+// Node kinds are registered globally by goldmark, so they need to be created
+// once rather than every time a message is parsed. ast.NewNodeKind appends to
+// an unsynchronized slice, so creating them per parse grew it forever and
+// raced when messages were parsed concurrently.
+var (
+	kindUnderline     = ast.NewNodeKind("Underline")
+	kindSpoiler       = ast.NewNodeKind("Spoiler")
+	kindStrikethrough = ast.NewNodeKind("Strikethrough")
+)
+
 type multiCharInlineParser struct {
 	baseChar  byte
 	processor *multiCharDelimiterProcessor
@@ -274,12 +294,12 @@ type multiCharInlineParser struct {
 // extension.NewStrikethroughParser, but generalized so it can work with
 // multiple types of characters, allowing for support of underline,
 // strikethrough, and spoiler tags with the same code.
-func newMultiCharInlineParser(baseChar byte, kind string) parser.InlineParser {
+func newMultiCharInlineParser(baseChar byte, kind ast.NodeKind) parser.InlineParser {
 	return &multiCharInlineParser{
 		baseChar: baseChar,
 		processor: &multiCharDelimiterProcessor{
 			baseChar: baseChar,
-			kind:     ast.NewNodeKind(kind),
+			kind:     kind,
 		},
 	}
 }
@@ -1,6 +1,7 @@
 package seabird_discord
 
 import (
+	"sync"
 	"testing"
 
 	"github.com/seabird-chat/seabird-go"
@@ -112,6 +113,22 @@ func TestTextToBlocks(t *testing.T) {
 				),
 			),
 		},
+		{
+			name:  "newline-simple",
+			input: "hello\nworld",
+			expected: seabird.NewContainerBlock(
+				seabird.NewTextBlock("hello\n"),
+				seabird.NewTextBlock("world"),
+			),
+		},
+		{
+			name:  "escaped-simple",
+			input: `\*hello\* \_\_world\_\_`,
+			expected: seabird.NewContainerBlock(
+				seabird.NewTextBlock("*hello*"),
+				seabird.NewTextBlock(" __world__"),
+			),
+		},
 		{
 			name:     "heading-simple",
 			input:    "# 1",
@@ -287,3 +304,19 @@ func TestTextToBlocks(t *testing.T) {
 		})
 	}
 }
+
+func TestTextToBlockConcurrent(t *testing.T) {
+	// Messages are parsed from many handlers at once, so this is mostly useful
+	// with the race detector.
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+
+			_, _, err := TextToBlock("__underline__ ||spoiler|| ~~strike~~")
+			assert.NoError(t, err)
+		}()
+	}
+	wg.Wait()
+}
@@ -0,0 +1,235 @@
+package seabird_discord
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/seabird-chat/seabird-go/pb"
+	"google.golang.org/protobuf/proto"
+)
+
+const metricsNamespace = "seabird_discord"
+
+// metrics contains everything exposed on the metrics endpoint. Each backend
+// has its own registry so they don't conflict with each other in tests.
+type metrics struct {
+	registry *prometheus.Registry
+
+	inboundEvents    *prometheus.CounterVec
+	outboundRequests *prometheus.CounterVec
+	reconnects       prometheus.Counter
+	restDuration     *prometheus.HistogramVec
+}
+
+func newMetrics(b *Backend) *metrics {
+	m := &metrics{
+		registry: prometheus.NewRegistry(),
+		inboundEvents: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "inbound_events_total",
+			Help:      "Events sent to seabird-core, by event type.",
+		}, []string{"type", "guild"}),
+		outboundRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "outbound_requests_total",
+			Help:      "Requests from seabird-core which have been processed, by request type and result.",
+		}, []string{"type", "result", "guild"}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "ingest_reconnects_total",
+			Help:      "Attempts to reconnect to seabird-core after the ingest stream was lost.",
+		}),
+		restDuration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: metricsNamespace,
+			Name:      "discord_rest_duration_seconds",
+			Help:      "Latency of requests to the Discord REST API.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"method", "route", "status"}),
+	}
+
+	m.registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		m.inboundEvents,
+		m.outboundRequests,
+		m.reconnects,
+		m.restDuration,
+		prometheus.NewCounterFunc(prometheus.CounterOpts{
+			Namespace: metricsNamespace,
+			Name:      "dropped_events_total",
+			Help:      "Events which couldn't be sent to seabird-core.",
+		}, func() float64 { return float64(b.EventStats().Dropped) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "output_stream_length",
+			Help:      "Events waiting to be sent on the ingest stream.",
+		}, func() float64 { return float64(len(b.outputStream)) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "event_queue_length",
+			Help:      "Events buffered while seabird-core is unavailable.",
+		}, func() float64 { return float64(b.EventStats().QueueLength) }),
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "ingest_connected",
+			Help:      "Whether the ingest stream to seabird-core is connected.",
+		}, func() float64 {
+			if b.ingestConnected.Load() {
+				return 1
+			}
+			return 0
+		}),
+	)
+
+	return m
+}
+
+// oneofName returns the name of the field set in a message's inner oneof,
+// such as "send_message", or "unknown" if there isn't one.
+func oneofName(msg proto.Message) string {
+	ref := msg.ProtoReflect()
+
+	oneof := ref.Descriptor().Oneofs().ByName("inner")
+	if oneof == nil {
+		return "unknown"
+	}
+
+	field := ref.WhichOneof(oneof)
+	if field == nil {
+		return "unknown"
+	}
+
+	return string(field.Name())
+}
+
+// eventChannelID returns the channel an event relates to, or an empty string
+// for private events.
+func eventChannelID(e *pb.ChatEvent) string {
+	switch v := e.Inner.(type) {
+	case *pb.ChatEvent_Message:
+		return v.Message.GetSource().GetChannelId()
+	case *pb.ChatEvent_Action:
+		return v.Action.GetSource().GetChannelId()
+	case *pb.ChatEvent_Command:
+		return v.Command.GetSource().GetChannelId()
+	case *pb.ChatEvent_Mention:
+		return v.Mention.GetSource().GetChannelId()
+	case *pb.ChatEvent_JoinChannel:
+		return v.JoinChannel.GetChannelId()
+	case *pb.ChatEvent_LeaveChannel:
+		return v.LeaveChannel.GetChannelId()
+	case *pb.ChatEvent_ChangeChannel:
+		return v.ChangeChannel.GetChannelId()
+	default:
+		return ""
+	}
+}
+
+// channelGuild returns the guild a channel belongs to, or an empty string if
+// it isn't known.
+func (b *Backend) channelGuild(channelID string) string {
+	if channelID == "" {
+		return ""
+	}
+
+	channel, err := b.session.State().Channel(channelID)
+	if err != nil {
+		return ""
+	}
+
+	return channel.GuildID
+}
+
+func (b *Backend) observeInboundEvent(e *pb.ChatEvent) {
+	b.metrics.inboundEvents.WithLabelValues(oneofName(e), b.channelGuild(eventChannelID(e))).Inc()
+}
+
+func (b *Backend) observeOutboundRequest(requestType, channelID string, err error) {
+	result := "success"
+	if err != nil {
+		result = "failure"
+	}
+
+	b.metrics.outboundRequests.WithLabelValues(requestType, result, b.channelGuild(channelID)).Inc()
+}
+
+// restTransport times requests made to the Discord REST API.
+type restTransport struct {
+	next    http.RoundTripper
+	observe func(method, route, status string, duration time.Duration)
+}
+
+func (t *restTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+
+	status := "error"
+	if err == nil {
+		status = strconv.Itoa(resp.StatusCode)
+	}
+
+	t.observe(req.Method, restRoute(req.URL.Path), status, time.Since(start))
+
+	return resp, err
+}
+
+// restRouteWords are the fixed segments of Discord REST API paths. Anything
+// else in a path is an ID, token, emoji or other value supplied by the caller.
+var restRouteWords = map[string]bool{
+	"@me": true, "@original": true, "active": true, "api": true,
+	"applications": true, "archived": true, "attachments": true,
+	"audit-logs": true, "auto-moderation": true, "bans": true, "bot": true,
+	"bulk-delete": true, "callback": true, "channels": true, "commands": true,
+	"connections": true, "crosspost": true, "emojis": true, "followers": true,
+	"gateway": true, "guilds": true, "integrations": true,
+	"interactions": true, "invites": true, "member": true, "members": true,
+	"messages": true, "onboarding": true, "permissions": true, "pins": true,
+	"preview": true, "private": true, "prune": true, "public": true,
+	"reactions": true, "regions": true, "roles": true, "rules": true,
+	"scheduled-events": true, "search": true, "stage-instances": true,
+	"sticker-packs": true, "stickers": true, "templates": true,
+	"thread-members": true, "threads": true, "typing": true, "users": true,
+	"voice-states": true, "webhooks": true, "widget": true,
+	"v" + discordgo.APIVersion: true,
+}
+
+// restRoute replaces everything other than fixed route words in a REST API
+// path with placeholders, so it can be used as a label without creating a
+// new series for every channel, and without leaking tokens.
+func restRoute(path string) string {
+	parts := strings.Split(path, "/")
+	for i, part := range parts {
+		if part == "" || restRouteWords[part] {
+			continue
+		}
+
+		// Webhook and interaction tokens follow the ID. They're secrets, so
+		// they're marked separately to make it obvious they were removed.
+		if i >= 2 && (parts[i-2] == "webhooks" || parts[i-2] == "interactions") {
+			parts[i] = ":token"
+		} else {
+			parts[i] = ":id"
+		}
+	}
+
+	return strings.Join(parts, "/")
+}
+
+func (b *Backend) instrumentREST(client *http.Client) {
+	next := client.Transport
+	if next == nil {
+		next = http.DefaultTransport
+	}
+
+	client.Transport = &restTransport{
+		next: next,
+		observe: func(method, route, status string, duration time.Duration) {
+			b.metrics.restDuration.WithLabelValues(method, route, status).Observe(duration.Seconds())
+		},
+	}
+}
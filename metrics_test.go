@@ -0,0 +1,106 @@
+package seabird_discord
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/seabird-chat/seabird-go/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestOneofName(t *testing.T) {
+	assert.Equal(t, "send_message", oneofName(&pb.ChatRequest{
+		Inner: &pb.ChatRequest_SendMessage{SendMessage: &pb.SendMessageChatRequest{}},
+	}))
+	assert.Equal(t, "private_message", oneofName(&pb.ChatEvent{
+		Inner: &pb.ChatEvent_PrivateMessage{PrivateMessage: &pb.PrivateMessageEvent{}},
+	}))
+	assert.Equal(t, "unknown", oneofName(&pb.ChatEvent{}))
+	assert.Equal(t, "unknown", oneofName(&pb.User{}))
+}
+
+func TestRestRoute(t *testing.T) {
+	assert.Equal(t, "/api/v9/channels/:id/messages", restRoute("/api/v9/channels/123456789012345678/messages"))
+	assert.Equal(t, "/api/v9/users/@me/channels", restRoute("/api/v9/users/@me/channels"))
+	assert.Equal(t, "/api/v9/webhooks/:id/:token", restRoute("/api/v9/webhooks/123/abcDEF-secret"))
+	assert.Equal(t, "/api/v9/webhooks/:id/:token/messages/@original", restRoute("/api/v9/webhooks/123/abc/messages/@original"))
+
+	// Interaction tokens are secrets as well, both in callbacks and in
+	// follow-ups, which go through the application's webhook.
+	assert.Equal(t, "/api/v9/interactions/:id/:token/callback", restRoute("/api/v9/interactions/123/aW50ZXJhY3Rpb24-secret/callback"))
+	assert.Equal(t, "/api/v9/webhooks/:id/:token", restRoute("/api/v9/webhooks/456/aW50ZXJhY3Rpb24-secret"))
+	assert.Equal(t, "/api/v9/webhooks/:id/:token/messages/:id", restRoute("/api/v9/webhooks/456/aW50ZXJhY3Rpb24-secret/messages/789"))
+
+	// Anything which isn't part of a known route is collapsed, so callers
+	// can't create new series.
+	assert.Equal(t, "/api/v9/channels/:id/messages/:id/reactions/:id/@me", restRoute("/api/v9/channels/1/messages/2/reactions/%F0%9F%91%8D/@me"))
+	assert.Equal(t, "/api/v9/channels/:id", restRoute("/api/v9/channels/general"))
+}
+
+func TestRestTransport(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer server.Close()
+
+	b := &Backend{outputStream: make(chan *pb.ChatEvent, 10)}
+	b.metrics = newMetrics(b)
+
+	client := &http.Client{}
+	b.instrumentREST(client)
+
+	resp, err := client.Post(server.URL+"/api/v9/channels/123/messages", "application/json", nil)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, 1, testutil.CollectAndCount(b.metrics.restDuration))
+
+	var observed []string
+	transport := &restTransport{
+		next: http.DefaultTransport,
+		observe: func(method, route, status string, duration time.Duration) {
+			observed = append(observed, method, route, status)
+		},
+	}
+
+	req, err := http.NewRequest(http.MethodGet, server.URL+"/api/v9/channels/123", nil)
+	require.NoError(t, err)
+	resp, err = transport.RoundTrip(req)
+	require.NoError(t, err)
+	resp.Body.Close()
+
+	assert.Equal(t, []string{"GET", "/api/v9/channels/:id", "429"}, observed)
+}
+
+func TestMetricsRegistry(t *testing.T) {
+	b := &Backend{outputStream: make(chan *pb.ChatEvent, 10)}
+	b.metrics = newMetrics(b)
+
+	b.outputStream <- &pb.ChatEvent{}
+	b.droppedEvents.Add(2)
+	b.observeOutboundRequest("send_message", "", nil)
+
+	families, err := b.metrics.registry.Gather()
+	require.NoError(t, err)
+
+	values := make(map[string]float64)
+	for _, family := range families {
+		for _, metric := range family.Metric {
+			switch {
+			case metric.Counter != nil:
+				values[family.GetName()] += metric.Counter.GetValue()
+			case metric.Gauge != nil:
+				values[family.GetName()] += metric.Gauge.GetValue()
+			}
+		}
+	}
+
+	assert.Equal(t, 1.0, values["seabird_discord_output_stream_length"])
+	assert.Equal(t, 2.0, values["seabird_discord_dropped_events_total"])
+	assert.Equal(t, 0.0, values["seabird_discord_ingest_connected"])
+	assert.Equal(t, 1.0, testutil.ToFloat64(b.metrics.outboundRequests.WithLabelValues("send_message", "success", "")))
+}
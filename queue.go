@@ -0,0 +1,282 @@
+package seabird_discord
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/seabird-chat/seabird-go/pb"
+)
+
+// queueRecordHeaderSize is the size of the timestamp and length which are
+// written before each event in the queue file.
+const queueRecordHeaderSize = 8 + 4
+
+type queuedEvent struct {
+	queuedAt time.Time
+	data     []byte
+}
+
+// eventQueue is a disk-backed FIFO of events which couldn't be sent to
+// seabird-core. Events are kept in memory and mirrored to a file so they
+// survive a restart. The queue is bounded both by the total size of the
+// stored events and by how long they have been waiting.
+//
+// Note that events are only removed from the file when the queue is fully
+// drained, so if the backend exits in the middle of a replay, some events may
+// be sent twice.
+type eventQueue struct {
+	lock    sync.Mutex
+	path    string
+	file    *os.File
+	events  []queuedEvent
+	size    int
+	maxSize int
+	maxAge  time.Duration
+
+	// C is notified whenever an event is added to the queue.
+	C chan struct{}
+
+	// dropped tracks how many events have been dropped because of the
+	// configured limits. This is read and reset by the backend.
+	dropped int
+}
+
+func newEventQueue(path string, maxSize int, maxAge time.Duration) (*eventQueue, error) {
+	q := &eventQueue{
+		path:    path,
+		maxSize: maxSize,
+		maxAge:  maxAge,
+		C:       make(chan struct{}, 1),
+	}
+
+	err := q.load()
+	if err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+// load reads any events left over from a previous run and re-writes the queue
+// file with only the events we want to keep.
+func (q *eventQueue) load() error {
+	f, err := os.Open(q.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to open event queue: %w", err)
+	}
+
+	if f != nil {
+		defer f.Close()
+
+		r := bufio.NewReader(f)
+		for {
+			header := make([]byte, queueRecordHeaderSize)
+			if _, err := io.ReadFull(r, header); err != nil {
+				// A partial record at the end of the file means we were
+				// interrupted in the middle of a write, so it's safe to drop.
+				break
+			}
+
+			data := make([]byte, binary.BigEndian.Uint32(header[8:]))
+			if _, err := io.ReadFull(r, data); err != nil {
+				break
+			}
+
+			q.events = append(q.events, queuedEvent{
+				queuedAt: time.Unix(0, int64(binary.BigEndian.Uint64(header[:8]))),
+				data:     data,
+			})
+			q.size += len(data)
+		}
+	}
+
+	q.expire(time.Now())
+	q.trim()
+
+	return q.rewrite()
+}
+
+// Push adds an event to the end of the queue. If the queue is over its size
+// limit, the oldest events are dropped to make room.
+func (q *eventQueue) Push(e *pb.ChatEvent) error {
+	data, err := proto.Marshal(e)
+	if err != nil {
+		return err
+	}
+
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	item := queuedEvent{queuedAt: time.Now(), data: data}
+
+	q.events = append(q.events, item)
+	q.size += len(data)
+
+	if q.trim() {
+		err = q.rewrite()
+	} else {
+		err = q.append(item)
+	}
+
+	select {
+	case q.C <- struct{}{}:
+	default:
+	}
+
+	return err
+}
+
+// Peek returns the oldest event in the queue without removing it. Any events
+// which have been waiting longer than the max age are dropped.
+func (q *eventQueue) Peek() (*pb.ChatEvent, bool) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	for {
+		q.expire(time.Now())
+
+		if len(q.events) == 0 {
+			return nil, false
+		}
+
+		e := &pb.ChatEvent{}
+		err := proto.Unmarshal(q.events[0].data, e)
+		if err == nil {
+			return e, true
+		}
+
+		// If an event can't be decoded, there's nothing we can do with it.
+		q.pop()
+		q.dropped++
+	}
+}
+
+// Pop removes the oldest event from the queue. When the queue is empty, the
+// file is truncated.
+func (q *eventQueue) Pop() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	q.pop()
+
+	if len(q.events) == 0 {
+		return q.rewrite()
+	}
+
+	return nil
+}
+
+// Len returns the number of events in the queue.
+func (q *eventQueue) Len() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	return len(q.events)
+}
+
+// TakeDropped returns the number of events dropped since the last call.
+func (q *eventQueue) TakeDropped() int {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	ret := q.dropped
+	q.dropped = 0
+	return ret
+}
+
+func (q *eventQueue) Close() error {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+
+	if q.file == nil {
+		return nil
+	}
+
+	err := q.file.Close()
+	q.file = nil
+	return err
+}
+
+func (q *eventQueue) pop() {
+	q.size -= len(q.events[0].data)
+	q.events[0] = queuedEvent{}
+	q.events = q.events[1:]
+}
+
+// expire drops any events older than the max age. Because events are always
+// added in order, we only need to look at the front of the queue.
+func (q *eventQueue) expire(now time.Time) {
+	if q.maxAge <= 0 {
+		return
+	}
+
+	for len(q.events) > 0 && now.Sub(q.events[0].queuedAt) > q.maxAge {
+		q.pop()
+		q.dropped++
+	}
+}
+
+// trim drops the oldest events until the queue fits in the max size. It
+// returns true if anything was dropped.
+func (q *eventQueue) trim() bool {
+	if q.maxSize <= 0 {
+		return false
+	}
+
+	var trimmed bool
+	for len(q.events) > 0 && q.size > q.maxSize {
+		q.pop()
+		q.dropped++
+		trimmed = true
+	}
+
+	return trimmed
+}
+
+// append writes a single event to the end of the queue file.
+func (q *eventQueue) append(item queuedEvent) error {
+	if q.file == nil {
+		return errors.New("event queue is closed")
+	}
+
+	_, err := q.file.Write(encodeQueuedEvent(item))
+	return err
+}
+
+// rewrite replaces the queue file with the current contents of the queue.
+func (q *eventQueue) rewrite() error {
+	if q.file != nil {
+		q.file.Close()
+	}
+
+	f, err := os.OpenFile(q.path, os.O_CREATE|os.O_RDWR|os.O_TRUNC, 0o600)
+	if err != nil {
+		return fmt.Errorf("failed to open event queue: %w", err)
+	}
+	q.file = f
+
+	w := bufio.NewWriter(f)
+	for _, item := range q.events {
+		if _, err := w.Write(encodeQueuedEvent(item)); err != nil {
+			return err
+		}
+	}
+
+	return w.Flush()
+}
+
+func encodeQueuedEvent(item queuedEvent) []byte {
+	buf := make([]byte, queueRecordHeaderSize+len(item.data))
+	binary.BigEndian.PutUint64(buf[:8], uint64(item.queuedAt.UnixNano()))
+	binary.BigEndian.PutUint32(buf[8:12], uint32(len(item.data)))
+	copy(buf[queueRecordHeaderSize:], item.data)
+	return buf
+}
@@ -0,0 +1,92 @@
+package seabird_discord
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"google.golang.org/protobuf/proto"
+
+	"github.com/seabird-chat/seabird-go/pb"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testQueueEvent(id string) *pb.ChatEvent {
+	return &pb.ChatEvent{
+		Id:    id,
+		Inner: &pb.ChatEvent_Success{Success: &pb.SuccessChatEvent{}},
+	}
+}
+
+func drainQueue(t *testing.T, q *eventQueue) []string {
+	t.Helper()
+
+	var ret []string
+	for {
+		e, ok := q.Peek()
+		if !ok {
+			return ret
+		}
+
+		ret = append(ret, e.Id)
+		require.NoError(t, q.Pop())
+	}
+}
+
+func TestEventQueuePersistence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "queue")
+
+	q, err := newEventQueue(path, 0, 0)
+	require.NoError(t, err)
+
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, q.Push(testQueueEvent(id)))
+	}
+	require.NoError(t, q.Close())
+
+	// Simulate being interrupted in the middle of a write.
+	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	q, err = newEventQueue(path, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b", "c"}, drainQueue(t, q))
+	require.NoError(t, q.Close())
+
+	// Once drained, nothing should be left on disk.
+	q, err = newEventQueue(path, 0, 0)
+	require.NoError(t, err)
+	assert.Equal(t, 0, q.Len())
+	require.NoError(t, q.Close())
+}
+
+func TestEventQueueLimits(t *testing.T) {
+	data, err := proto.Marshal(testQueueEvent("a"))
+	require.NoError(t, err)
+
+	// The queue should only be able to fit 2 events.
+	q, err := newEventQueue(filepath.Join(t.TempDir(), "queue"), 2*len(data), 0)
+	require.NoError(t, err)
+	defer q.Close()
+
+	for _, id := range []string{"a", "b", "c"} {
+		require.NoError(t, q.Push(testQueueEvent(id)))
+	}
+
+	assert.Equal(t, 1, q.TakeDropped())
+	assert.Equal(t, []string{"b", "c"}, drainQueue(t, q))
+
+	q.maxAge = time.Millisecond
+	require.NoError(t, q.Push(testQueueEvent("d")))
+	time.Sleep(5 * time.Millisecond)
+
+	_, ok := q.Peek()
+	assert.False(t, ok)
+	assert.Equal(t, 1, q.TakeDropped())
+}
@@ -0,0 +1,101 @@
+package seabird_discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+	"github.com/seabird-chat/seabird-go/pb"
+)
+
+func (b *Backend) handleMessageReactionAdd(s *discordgo.Session, m *discordgo.MessageReactionAdd) {
+	b.handleReaction(m.MessageReaction, m.Member, "add")
+}
+
+func (b *Backend) handleMessageReactionRemove(s *discordgo.Session, m *discordgo.MessageReactionRemove) {
+	b.handleReaction(m.MessageReaction, nil, "remove")
+}
+
+// handleReaction sends a reaction to seabird. The ingest protocol has no
+// reaction events, so it is sent as a message containing the emoji, tagged
+// with TagReaction. Member is only included by Discord when a reaction is
+// added in a guild.
+func (b *Backend) handleReaction(r *discordgo.MessageReaction, member *discordgo.Member, action string) {
+	if !b.settings.Load().forwardReactions {
+		return
+	}
+
+	if r.UserID == b.session.BotUserID() || !b.listening.IsListening(r.ChannelID) {
+		return
+	}
+
+	emoji := reactionEmoji(r.Emoji)
+	if emoji == "" {
+		return
+	}
+
+	rootBlock, _, err := TextToBlock(emoji)
+	if err != nil {
+		b.logger.Warn().Err(err).Msg("failed to convert reaction to blocks")
+		return
+	}
+
+	user := b.reactionUser(r, member)
+
+	e := &pb.ChatEvent{
+		Id: newEventID(),
+		Tags: map[string]string{
+			TagMessageID: r.MessageID,
+			TagReaction:  action,
+			TagEmoji:     emoji,
+		},
+	}
+
+	// Only guild channels have a guild ID, so anything else is a DM.
+	if r.GuildID == "" {
+		e.Inner = &pb.ChatEvent_PrivateMessage{PrivateMessage: &pb.PrivateMessageEvent{
+			Source:    user,
+			RootBlock: rootBlock,
+		}}
+	} else {
+		e.Inner = &pb.ChatEvent_Message{Message: &pb.MessageEvent{
+			Source:    &pb.ChannelSource{ChannelId: r.ChannelID, User: user},
+			RootBlock: rootBlock,
+		}}
+	}
+
+	// Replying to a reaction replies to the message which was reacted to.
+	b.recentMessages.Add(e.Id, messageContext{
+		GuildID:   r.GuildID,
+		ChannelID: r.ChannelID,
+		MessageID: r.MessageID,
+	})
+
+	b.writeEvent(e)
+}
+
+// reactionEmoji formats an emoji the same way ReplaceMentions does, so unicode
+// emoji are left alone and custom emoji become ":name:".
+func reactionEmoji(emoji discordgo.Emoji) string {
+	if emoji.ID == "" {
+		return emoji.Name
+	}
+
+	if emoji.Name == "" {
+		return ""
+	}
+
+	return ":" + emoji.Name + ":"
+}
+
+// reactionUser returns the user who reacted. Reaction events only include
+// the user's ID, so the name comes from the member if there is one, or the
+// state if not. If neither has it, the ID is used as the name.
+func (b *Backend) reactionUser(r *discordgo.MessageReaction, member *discordgo.Member) *pb.User {
+	if member == nil && r.GuildID != "" {
+		member, _ = b.session.State().Member(r.GuildID, r.UserID)
+	}
+
+	if member != nil && member.User != nil {
+		return &pb.User{Id: r.UserID, DisplayName: member.User.Username}
+	}
+
+	return &pb.User{Id: r.UserID, DisplayName: r.UserID}
+}
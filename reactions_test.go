@@ -0,0 +1,100 @@
+package seabird_discord
+
+import (
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/seabird-chat/seabird-go/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReactionEmoji(t *testing.T) {
+	assert.Equal(t, "👍", reactionEmoji(discordgo.Emoji{Name: "👍"}))
+	assert.Equal(t, ":party:", reactionEmoji(discordgo.Emoji{ID: "50", Name: "party"}))
+
+	// Custom emoji can lose their name if they've been deleted.
+	assert.Equal(t, "", reactionEmoji(discordgo.Emoji{ID: "50"}))
+}
+
+func TestBackendReactions(t *testing.T) {
+	config := DefaultConfig()
+	config.ForwardReactions = true
+
+	b, fake := newTestBackend(t, config)
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+
+	require.NoError(t, fake.Dispatch("MESSAGE_REACTION_ADD", &discordgo.MessageReactionAdd{
+		MessageReaction: &discordgo.MessageReaction{
+			UserID:    "2",
+			MessageID: "100",
+			ChannelID: "10",
+			GuildID:   "1",
+			Emoji:     discordgo.Emoji{ID: "50", Name: "party"},
+		},
+		Member: &discordgo.Member{User: testUser},
+	}))
+
+	e := nextEvent(t, b)
+	require.IsType(t, &pb.ChatEvent_Message{}, e.Inner)
+	assert.Equal(t, "10", e.GetMessage().Source.ChannelId)
+	assert.Equal(t, "2", e.GetMessage().Source.User.Id)
+	assert.Equal(t, "alice", e.GetMessage().Source.User.DisplayName)
+	assert.Equal(t, "add", e.Tags[TagReaction])
+	assert.Equal(t, ":party:", e.Tags[TagEmoji])
+	assert.Equal(t, "100", e.Tags[TagMessageID])
+
+	// Reactions from the bot itself are ignored, and removals don't include
+	// the member, so it comes from the state.
+	require.NoError(t, fake.Dispatch("MESSAGE_REACTION_ADD", &discordgo.MessageReaction{
+		UserID:    fake.BotUser.ID,
+		MessageID: "100",
+		ChannelID: "10",
+		GuildID:   "1",
+		Emoji:     discordgo.Emoji{Name: "👍"},
+	}))
+	require.NoError(t, fake.Dispatch("MESSAGE_REACTION_REMOVE", &discordgo.MessageReaction{
+		UserID:    "2",
+		MessageID: "100",
+		ChannelID: "10",
+		GuildID:   "1",
+		Emoji:     discordgo.Emoji{Name: "👍"},
+	}))
+
+	e = nextEvent(t, b)
+	require.IsType(t, &pb.ChatEvent_Message{}, e.Inner)
+	assert.Equal(t, "alice", e.GetMessage().Source.User.DisplayName)
+	assert.Equal(t, "remove", e.Tags[TagReaction])
+	assert.Equal(t, "👍", e.Tags[TagEmoji])
+
+	// Replies to a reaction event reference the message which was reacted
+	// to.
+	ref := b.messageReference("10", map[string]string{TagReplyTo: e.Id})
+	require.NotNil(t, ref)
+	assert.Equal(t, "100", ref.MessageID)
+}
+
+func TestBackendReactionsDisabled(t *testing.T) {
+	b, fake := newTestBackend(t, DefaultConfig())
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+	require.NoError(t, fake.Dispatch("MESSAGE_REACTION_ADD", &discordgo.MessageReaction{
+		UserID:    "2",
+		MessageID: "100",
+		ChannelID: "10",
+		GuildID:   "1",
+		Emoji:     discordgo.Emoji{Name: "👍"},
+	}))
+	require.NoError(t, fake.Dispatch("MESSAGE_CREATE", &discordgo.Message{
+		ID:        "101",
+		ChannelID: "10",
+		GuildID:   "1",
+		Content:   "hello",
+		Author:    testUser,
+	}))
+
+	e := nextEvent(t, b)
+	assert.Empty(t, e.Tags[TagReaction])
+	assert.Equal(t, "101", e.Tags[TagMessageID])
+}
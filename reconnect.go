@@ -0,0 +1,181 @@
+package seabird_discord
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// ConnState represents the state of the ingest stream to seabird-core.
+type ConnState int
+
+const (
+	ConnStateDisconnected ConnState = iota
+	ConnStateConnecting
+	ConnStateConnected
+	ConnStateBackoff
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case ConnStateDisconnected:
+		return "disconnected"
+	case ConnStateConnecting:
+		return "connecting"
+	case ConnStateConnected:
+		return "connected"
+	case ConnStateBackoff:
+		return "backoff"
+	default:
+		return "unknown"
+	}
+}
+
+// BackoffConfig controls how long to wait between reconnect attempts. The
+// delay starts at Min and is multiplied by Factor after every failed attempt,
+// up to Max. Jitter is the fraction of the delay which is randomized, so a
+// Jitter of 0.2 results in a delay between 80% and 120% of the base value.
+type BackoffConfig struct {
+	Min    time.Duration `yaml:"min"`
+	Max    time.Duration `yaml:"max"`
+	Factor float64       `yaml:"factor"`
+	Jitter float64       `yaml:"jitter"`
+}
+
+// DefaultBackoffConfig is used for any values which are not set.
+var DefaultBackoffConfig = BackoffConfig{
+	Min:    1 * time.Second,
+	Max:    2 * time.Minute,
+	Factor: 2,
+	Jitter: 0.2,
+}
+
+func (c BackoffConfig) withDefaults() BackoffConfig {
+	if c.Min <= 0 {
+		c.Min = DefaultBackoffConfig.Min
+	}
+	if c.Max <= 0 {
+		c.Max = DefaultBackoffConfig.Max
+	}
+	if c.Max < c.Min {
+		c.Max = c.Min
+	}
+	if c.Factor < 1 {
+		c.Factor = DefaultBackoffConfig.Factor
+	}
+	if c.Jitter < 0 {
+		c.Jitter = 0
+	} else if c.Jitter > 1 {
+		c.Jitter = 1
+	}
+
+	return c
+}
+
+// reconnectManager tracks the state of a connection and how long to wait
+// before the next attempt. Observers are called synchronously on every state
+// change, so they must not block.
+type reconnectManager struct {
+	config BackoffConfig
+
+	lock      sync.Mutex
+	state     ConnState
+	since     time.Time
+	attempt   int
+	observers []func(prev, next ConnState)
+}
+
+func newReconnectManager(config BackoffConfig) *reconnectManager {
+	return &reconnectManager{
+		config: config.withDefaults(),
+		state:  ConnStateDisconnected,
+		since:  time.Now(),
+	}
+}
+
+// OnStateChange registers a function to be called whenever the state changes.
+func (m *reconnectManager) OnStateChange(fn func(prev, next ConnState)) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	m.observers = append(m.observers, fn)
+}
+
+// State returns the current state and when it was entered.
+func (m *reconnectManager) State() (ConnState, time.Time) {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	return m.state, m.since
+}
+
+func (m *reconnectManager) setState(state ConnState) {
+	m.lock.Lock()
+
+	prev := m.state
+	if prev == state {
+		m.lock.Unlock()
+		return
+	}
+
+	m.state = state
+	m.since = time.Now()
+
+	// A successful connection means we can start over with the shortest
+	// delay next time.
+	if state == ConnStateConnected {
+		m.attempt = 0
+	}
+
+	observers := m.observers
+	m.lock.Unlock()
+
+	for _, fn := range observers {
+		fn(prev, state)
+	}
+}
+
+func (m *reconnectManager) Connecting()   { m.setState(ConnStateConnecting) }
+func (m *reconnectManager) Connected()    { m.setState(ConnStateConnected) }
+func (m *reconnectManager) Disconnected() { m.setState(ConnStateDisconnected) }
+
+// nextDelay returns how long to wait before the next attempt and advances the
+// backoff.
+func (m *reconnectManager) nextDelay() time.Duration {
+	m.lock.Lock()
+	defer m.lock.Unlock()
+
+	delay := float64(m.config.Min)
+	for i := 0; i < m.attempt && delay < float64(m.config.Max); i++ {
+		delay *= m.config.Factor
+	}
+	if delay > float64(m.config.Max) {
+		delay = float64(m.config.Max)
+	}
+
+	m.attempt++
+
+	if m.config.Jitter > 0 {
+		delay *= 1 + m.config.Jitter*(2*rand.Float64()-1)
+	}
+
+	return time.Duration(delay)
+}
+
+// Backoff waits before the next connection attempt. It returns early with the
+// context's error if the context is cancelled.
+func (m *reconnectManager) Backoff(ctx context.Context) (time.Duration, error) {
+	delay := m.nextDelay()
+	m.setState(ConnStateBackoff)
+
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return delay, nil
+	case <-ctx.Done():
+		return delay, ctx.Err()
+	}
+}
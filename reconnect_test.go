@@ -0,0 +1,72 @@
+package seabird_discord
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestReconnectBackoff(t *testing.T) {
+	m := newReconnectManager(BackoffConfig{
+		Min:    time.Second,
+		Max:    5 * time.Second,
+		Factor: 2,
+	})
+
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, m.nextDelay())
+	}
+	assert.Equal(t, []time.Duration{
+		time.Second,
+		2 * time.Second,
+		4 * time.Second,
+		5 * time.Second,
+		5 * time.Second,
+	}, delays)
+
+	// Connecting successfully should start over.
+	m.Connected()
+	assert.Equal(t, time.Second, m.nextDelay())
+
+	m = newReconnectManager(BackoffConfig{Min: time.Second, Jitter: 0.5})
+	for i := 0; i < 100; i++ {
+		delay := m.nextDelay()
+		m.Connected()
+		m.Disconnected()
+		assert.GreaterOrEqual(t, delay, 500*time.Millisecond)
+		assert.LessOrEqual(t, delay, 1500*time.Millisecond)
+	}
+}
+
+func TestReconnectState(t *testing.T) {
+	m := newReconnectManager(BackoffConfig{Min: time.Hour})
+
+	var transitions []string
+	m.OnStateChange(func(prev, next ConnState) {
+		transitions = append(transitions, prev.String()+"->"+next.String())
+	})
+
+	m.Connecting()
+	m.Connected()
+	m.Connected()
+	m.Disconnected()
+
+	// Backoff should return as soon as the context is cancelled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err := m.Backoff(ctx)
+	require.ErrorIs(t, err, context.Canceled)
+
+	state, _ := m.State()
+	assert.Equal(t, ConnStateBackoff, state)
+	assert.Equal(t, []string{
+		"disconnected->connecting",
+		"connecting->connected",
+		"connected->disconnected",
+		"disconnected->backoff",
+	}, transitions)
+}
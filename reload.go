@@ -0,0 +1,178 @@
+package seabird_discord
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"slices"
+	"sort"
+	"syscall"
+	"time"
+)
+
+// runtimeSettings contains the parts of the config which can be changed
+// without reconnecting. It is never modified once it has been stored, so a
+// reload swaps in a new copy.
+type runtimeSettings struct {
+	prefixes         []string
+	mentionCommands  bool
+	forwardReactions bool
+	forwardEdits     bool
+	channelMap       map[string]string
+	guilds           map[string]GuildConfig
+	channels         map[string]ChannelConfig
+}
+
+func newRuntimeSettings(config DiscordConfig) *runtimeSettings {
+	ret := &runtimeSettings{
+		prefixes:         sortPrefixes(config.CommandPrefixes),
+		mentionCommands:  config.MentionCommands,
+		forwardReactions: config.ForwardReactions,
+		forwardEdits:     config.ForwardEdits,
+		channelMap:       make(map[string]string),
+		guilds:           make(map[string]GuildConfig),
+		channels:         make(map[string]ChannelConfig),
+	}
+
+	for voiceChannel, channel := range config.VoiceChannels {
+		ret.channelMap[voiceChannel] = channel
+	}
+	for id, guild := range config.Guilds {
+		guild.CommandPrefixes = sortPrefixes(guild.CommandPrefixes)
+		ret.guilds[id] = guild
+	}
+	for id, channel := range config.Channels {
+		channel.CommandPrefixes = sortPrefixes(channel.CommandPrefixes)
+		ret.channels[id] = channel
+	}
+
+	return ret
+}
+
+// sortPrefixes returns a copy of prefixes with the longest first, so if one
+// prefix starts with another, like "!" and "!!", the longer one is matched.
+func sortPrefixes(prefixes []string) []string {
+	if len(prefixes) == 0 {
+		return nil
+	}
+
+	ret := slices.Clone(prefixes)
+	sort.SliceStable(ret, func(i, j int) bool {
+		return len(ret[i]) > len(ret[j])
+	})
+
+	return ret
+}
+
+// commandPrefixes returns the command prefixes for a channel, taking any
+// overrides into account. If prefix commands are disabled, it returns nil.
+func (s *runtimeSettings) commandPrefixes(guildID, channelID string) []string {
+	if channel, ok := s.channels[channelID]; ok {
+		if channel.DisablePrefixCommands {
+			return nil
+		}
+		if len(channel.CommandPrefixes) > 0 {
+			return channel.CommandPrefixes
+		}
+	}
+
+	if guild, ok := s.guilds[guildID]; ok {
+		if guild.DisablePrefixCommands {
+			return nil
+		}
+		if len(guild.CommandPrefixes) > 0 {
+			return guild.CommandPrefixes
+		}
+	}
+
+	return s.prefixes
+}
+
+// useWebhook returns true if a message to a channel should be sent through a
+// webhook, either because the request set a username or the channel is
+// configured to always use one.
+func (s *runtimeSettings) useWebhook(channelID string, tags map[string]string) bool {
+	return tags[TagUsername] != "" || s.channels[channelID].Webhook
+}
+
+// Reload validates a new config and applies any settings which can be changed
+// without reconnecting. If the config is invalid, the current settings are
+// kept.
+func (b *Backend) Reload(config DiscordConfig) error {
+	err := config.Validate()
+	if err != nil {
+		return err
+	}
+
+	b.settings.Store(newRuntimeSettings(config))
+
+	return nil
+}
+
+// reload loads and applies a new config, logging any errors.
+func (b *Backend) reload() {
+	config, err := b.reloadConfig()
+	if err == nil {
+		err = b.Reload(config)
+	}
+	if err != nil {
+		b.logger.Error().Err(err).Msg("failed to reload config, keeping previous config")
+		return
+	}
+
+	b.logger.Info().Msg("reloaded config")
+}
+
+// watchConfig reloads the config on SIGHUP or when the config file changes,
+// until the context is cancelled.
+func (b *Backend) watchConfig(ctx context.Context) {
+	if b.reloadConfig == nil {
+		return
+	}
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	var pollC <-chan time.Time
+	var lastMod time.Time
+	if b.configPath != "" && b.configPollInterval > 0 {
+		lastMod = configModTime(b.configPath)
+
+		ticker := time.NewTicker(b.configPollInterval)
+		defer ticker.Stop()
+		pollC = ticker.C
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			b.logger.Info().Msg("received SIGHUP, reloading config")
+			b.reload()
+		case <-pollC:
+			// If the file can't be read, we leave the config alone until it
+			// comes back rather than reporting an error every poll.
+			modTime := configModTime(b.configPath)
+			if modTime.IsZero() || modTime.Equal(lastMod) {
+				continue
+			}
+			lastMod = modTime
+
+			b.logger.Info().Str("path", b.configPath).Msg("config file changed, reloading config")
+			b.reload()
+		}
+	}
+}
+
+// configModTime returns when a file was last modified, or the zero time if it
+// can't be read.
+func configModTime(path string) time.Time {
+	info, err := os.Stat(path)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return info.ModTime()
+}
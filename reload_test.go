@@ -0,0 +1,109 @@
+package seabird_discord
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/rs/zerolog"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testReloadConfig() DiscordConfig {
+	config := DefaultConfig()
+	config.DiscordToken = "discord"
+	config.SeabirdHost = "localhost:11235"
+	config.SeabirdToken = "seabird"
+	return config
+}
+
+func TestRuntimeSettingsCommandPrefixes(t *testing.T) {
+	config := testReloadConfig()
+	config.CommandPrefixes = []string{"!", "!!"}
+	config.Guilds = map[string]GuildConfig{
+		"guild":    {CommandPrefixes: []string{"?"}},
+		"disabled": {DisablePrefixCommands: true},
+		"empty":    {},
+	}
+	config.Channels = map[string]ChannelConfig{
+		"channel":  {CommandPrefixes: []string{"."}},
+		"disabled": {DisablePrefixCommands: true},
+		"empty":    {},
+	}
+
+	s := newRuntimeSettings(config)
+
+	// Longer prefixes are matched first.
+	assert.Equal(t, []string{"!!", "!"}, s.commandPrefixes("", ""))
+	assert.Equal(t, []string{"!", "!!"}, config.CommandPrefixes)
+
+	assert.Equal(t, []string{"!!", "!"}, s.commandPrefixes("empty", ""))
+	assert.Equal(t, []string{"?"}, s.commandPrefixes("guild", "other"))
+	assert.Equal(t, []string{"?"}, s.commandPrefixes("guild", "empty"))
+	assert.Equal(t, []string{"."}, s.commandPrefixes("guild", "channel"))
+	assert.Equal(t, []string{"."}, s.commandPrefixes("disabled", "channel"))
+	assert.Nil(t, s.commandPrefixes("disabled", "other"))
+	assert.Nil(t, s.commandPrefixes("guild", "disabled"))
+}
+
+func TestBackendReload(t *testing.T) {
+	b := &Backend{logger: zerolog.Nop()}
+	b.settings.Store(newRuntimeSettings(testReloadConfig()))
+
+	config := testReloadConfig()
+	config.CommandPrefixes = []string{"?"}
+	config.VoiceChannels = map[string]string{"voice": "text"}
+	require.NoError(t, b.Reload(config))
+
+	assert.Equal(t, []string{"?"}, b.settings.Load().commandPrefixes("", ""))
+	assert.Equal(t, "text", b.settings.Load().channelMap["voice"])
+
+	// An invalid config leaves the previous settings in place.
+	config.CommandPrefixes = nil
+	assert.Error(t, b.Reload(config))
+	assert.Equal(t, []string{"?"}, b.settings.Load().commandPrefixes("", ""))
+}
+
+func TestWatchConfigPoll(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "config.yml")
+	require.NoError(t, os.WriteFile(path, []byte("command_prefixes: [\"!\"]\n"), 0o600))
+
+	b := &Backend{
+		logger:             zerolog.Nop(),
+		configPath:         path,
+		configPollInterval: 10 * time.Millisecond,
+		reloadConfig: func() (DiscordConfig, error) {
+			config := testReloadConfig()
+			err := LoadConfig(path, &config)
+			return config, err
+		},
+	}
+	b.settings.Store(newRuntimeSettings(testReloadConfig()))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.watchConfig(ctx)
+
+	// Make sure the watcher has seen the original file before changing it.
+	time.Sleep(50 * time.Millisecond)
+
+	// Some filesystems only have second precision, so we set the mtime
+	// explicitly rather than relying on the write.
+	require.NoError(t, os.WriteFile(path, []byte("command_prefixes: [\"?\"]\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(time.Minute)))
+
+	assert.Eventually(t, func() bool {
+		return slices.Equal(b.settings.Load().commandPrefixes("", ""), []string{"?"})
+	}, time.Second, 10*time.Millisecond)
+
+	// A broken file is logged and ignored.
+	require.NoError(t, os.WriteFile(path, []byte("command_prefixes: [\n"), 0o600))
+	require.NoError(t, os.Chtimes(path, time.Now(), time.Now().Add(2*time.Minute)))
+
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, []string{"?"}, b.settings.Load().commandPrefixes("", ""))
+}
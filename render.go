@@ -0,0 +1,334 @@
+package seabird_discord
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode"
+
+	"github.com/seabird-chat/seabird-go/pb"
+)
+
+// maxHeadingLevel is the deepest heading Discord will render. This matches
+// the limit used when parsing in TextToBlock.
+const maxHeadingLevel = 3
+
+var (
+	markdownEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		"*", `\*`,
+		"_", `\_`,
+		"~", `\~`,
+		"|", `\|`,
+		"`", "\\`",
+		"[", `\[`,
+		"]", `\]`,
+	)
+
+	// linkDestinationEscaper escapes anything which can't appear in a link
+	// destination wrapped in angle brackets.
+	linkDestinationEscaper = strings.NewReplacer(
+		`\`, `\\`,
+		"<", `\<`,
+		">", `\>`,
+	)
+
+	// urlRegexp matches anything Discord would linkify. We leave these
+	// unescaped because adding backslashes would break the link.
+	urlRegexp = regexp.MustCompile(`https?://[^\s<]+[^\s<.,:;"')\]]`)
+
+	// orderedListRegexp matches text which would be interpreted as the start
+	// of an ordered list item if it appeared at the start of a line.
+	orderedListRegexp = regexp.MustCompile(`^\d+[.)]`)
+)
+
+// BlockToText converts a seabird block tree into Discord flavored markdown. It
+// is intended to be the inverse of TextToBlock - any text nodes will be
+// escaped so they display exactly as they were sent.
+func BlockToText(block *pb.Block) string {
+	return newBlockRenderer(nil).render(block)
+}
+
+type blockRenderer struct {
+	replacer *strings.Replacer
+}
+
+// newBlockRenderer creates a renderer which optionally runs a replacer on all
+// text nodes before they are escaped. This is used for mention replacement,
+// as otherwise any underscores in usernames would be escaped.
+func newBlockRenderer(replacer *strings.Replacer) *blockRenderer {
+	return &blockRenderer{replacer: replacer}
+}
+
+func (r *blockRenderer) render(block *pb.Block) string {
+	if block == nil {
+		return ""
+	}
+
+	switch inner := block.Inner.(type) {
+	case *pb.Block_Text:
+		return r.renderText(inner.Text.Text)
+	case *pb.Block_InlineCode:
+		return renderInlineCode(inner.InlineCode.Text)
+	case *pb.Block_FencedCode:
+		fence := fencedCodeDelimiter(inner.FencedCode.Text)
+		return fmt.Sprintf("%s%s\n%s\n%s", fence, inner.FencedCode.Info, inner.FencedCode.Text, fence)
+	case *pb.Block_Italics:
+		return wrapEmphasis("*", r.render(inner.Italics.Inner))
+	case *pb.Block_Bold:
+		// Italics directly inside bold text need to use underscores, otherwise
+		// the asterisks would merge and be parsed the other way around.
+		if italics, ok := inner.Bold.Inner.GetInner().(*pb.Block_Italics); ok {
+			return wrapEmphasis("**", wrapEmphasis("_", r.render(italics.Italics.Inner)))
+		}
+		return wrapEmphasis("**", r.render(inner.Bold.Inner))
+	case *pb.Block_Underline:
+		return wrapInline("__", r.render(inner.Underline.Inner))
+	case *pb.Block_Strikethrough:
+		return wrapInline("~~", r.render(inner.Strikethrough.Inner))
+	case *pb.Block_Spoiler:
+		return wrapInline("||", r.render(inner.Spoiler.Inner))
+	case *pb.Block_Heading:
+		level := int(inner.Heading.Level)
+		if level < 1 {
+			level = 1
+		} else if level > maxHeadingLevel {
+			level = maxHeadingLevel
+		}
+
+		// Headings can only span a single line, so we collapse any newlines.
+		// Any surrounding whitespace is dropped by Discord, so we trim it.
+		text := strings.ReplaceAll(r.render(inner.Heading.Inner), "\n", " ")
+		text = strings.TrimSpace(text)
+
+		// A trailing # would be treated as a closing sequence and dropped.
+		if strings.HasSuffix(text, "#") && !strings.HasSuffix(text, `\#`) {
+			text = text[:len(text)-1] + `\#`
+		}
+
+		return strings.Repeat("#", level) + " " + text
+	case *pb.Block_Blockquote:
+		return prefixLines(r.render(inner.Blockquote.Inner), "> ", "> ")
+	case *pb.Block_List:
+		var items []string
+		for _, item := range inner.List.Inner {
+			items = append(items, prefixLines(r.render(item), "- ", "  "))
+		}
+		return strings.Join(items, "\n")
+	case *pb.Block_Link:
+		// If the link text is the URL, Discord will link it automatically, so
+		// we use the simpler form, as long as the whole URL would be linked.
+		url := inner.Link.Url
+		if text, ok := inner.Link.Inner.GetInner().(*pb.Block_Text); ok && text.Text.Text == url && urlRegexp.FindString(url) == url {
+			return url
+		}
+		return fmt.Sprintf("[%s](%s)", r.render(inner.Link.Inner), renderLinkDestination(url))
+	case *pb.Block_Timestamp:
+		return fmt.Sprintf("<t:%d:f>", inner.Timestamp.Inner.GetSeconds())
+	case *pb.Block_Container:
+		return r.renderContainer(inner.Container.Inner)
+	default:
+		// If we don't know what this block is, the best we can do is fall back
+		// to the plain text.
+		return r.renderText(block.Plain)
+	}
+}
+
+func (r *blockRenderer) renderContainer(blocks []*pb.Block) string {
+	var buf strings.Builder
+
+	var prev *pb.Block
+	for _, block := range blocks {
+		if prev != nil {
+			buf.WriteString(blockSeparator(prev, block))
+		}
+		buf.WriteString(r.render(block))
+		prev = block
+	}
+
+	return buf.String()
+}
+
+func (r *blockRenderer) renderText(text string) string {
+	if r.replacer != nil {
+		text = r.replacer.Replace(text)
+	}
+
+	return escapeMarkdown(text)
+}
+
+// wrapInline wraps text in an inline delimiter, skipping it entirely if there
+// is nothing to wrap.
+func wrapInline(delim string, text string) string {
+	if text == "" {
+		return ""
+	}
+
+	return delim + text + delim
+}
+
+// wrapEmphasis is similar to wrapInline, but because emphasis can't start or
+// end with whitespace, any surrounding whitespace is moved outside of the
+// delimiters.
+func wrapEmphasis(delim string, text string) string {
+	trimmed := strings.TrimFunc(text, unicode.IsSpace)
+	if trimmed == "" {
+		return text
+	}
+
+	start := strings.Index(text, trimmed)
+	end := start + len(trimmed)
+
+	return text[:start] + delim + trimmed + delim + text[end:]
+}
+
+// longestBacktickRun returns the length of the longest run of backticks in
+// text.
+func longestBacktickRun(text string) int {
+	var longest, cur int
+	for _, c := range text {
+		if c == '`' {
+			cur++
+			if cur > longest {
+				longest = cur
+			}
+		} else {
+			cur = 0
+		}
+	}
+
+	return longest
+}
+
+// fencedCodeDelimiter returns the fence for a code block. Like inline code, it needs to
+// be longer than any run of backticks in the code, otherwise the code block
+// would end early.
+func fencedCodeDelimiter(text string) string {
+	return strings.Repeat("`", max(3, longestBacktickRun(text)+1))
+}
+
+// renderLinkDestination returns the URL of a link in a form which can be put
+// inside parentheses. Anything with characters which would end the link
+// early, like ")" or a space, is wrapped in angle brackets.
+func renderLinkDestination(url string) string {
+	if !strings.ContainsAny(url, "()<> \\") {
+		return url
+	}
+
+	return "<" + linkDestinationEscaper.Replace(url) + ">"
+}
+
+func renderInlineCode(text string) string {
+	if text == "" {
+		return ""
+	}
+
+	// The delimiter needs to be longer than the longest run of backticks in
+	// the code itself.
+	delim := strings.Repeat("`", longestBacktickRun(text)+1)
+
+	// A single leading and trailing space is stripped from code spans (unless
+	// it's only spaces), so if the text starts or ends with something which
+	// would be ambiguous, we pad it.
+	if strings.Trim(text, " ") != "" && (strings.HasPrefix(text, "`") || strings.HasSuffix(text, "`") ||
+		strings.HasPrefix(text, " ") || strings.HasSuffix(text, " ")) {
+		text = " " + text + " "
+	}
+
+	return delim + text + delim
+}
+
+// blockSeparator returns what needs to go between two adjacent blocks in a
+// container. Nested containers are treated as paragraphs, as that's how
+// TextToBlock produces them.
+func blockSeparator(prev, next *pb.Block) string {
+	switch prev.Inner.(type) {
+	case *pb.Block_Blockquote, *pb.Block_List, *pb.Block_Container:
+		// A blank line is needed to end a blockquote, list or paragraph,
+		// otherwise the next line would be treated as a continuation of it.
+		return "\n\n"
+	}
+
+	switch next.Inner.(type) {
+	case *pb.Block_Container:
+		return "\n\n"
+	case *pb.Block_Heading, *pb.Block_FencedCode, *pb.Block_Blockquote, *pb.Block_List:
+		return "\n"
+	}
+
+	if _, ok := prev.Inner.(*pb.Block_Heading); ok {
+		return "\n"
+	}
+	if _, ok := prev.Inner.(*pb.Block_FencedCode); ok {
+		return "\n"
+	}
+
+	return ""
+}
+
+// prefixLines adds a prefix to every line of text. The first line gets a
+// different prefix so this can be used for list items as well as quotes.
+func prefixLines(text, first, rest string) string {
+	lines := strings.Split(text, "\n")
+	for i := range lines {
+		if i == 0 {
+			lines[i] = first + lines[i]
+		} else {
+			lines[i] = rest + lines[i]
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// escapeMarkdown escapes any characters in text which Discord would treat as
+// formatting. URLs are left alone so they can still be linkified.
+func escapeMarkdown(text string) string {
+	var buf strings.Builder
+
+	last := 0
+	for _, loc := range urlRegexp.FindAllStringIndex(text, -1) {
+		buf.WriteString(escapeMarkdownSegment(text[last:loc[0]], last == 0))
+		buf.WriteString(text[loc[0]:loc[1]])
+		last = loc[1]
+	}
+	buf.WriteString(escapeMarkdownSegment(text[last:], last == 0))
+
+	return buf.String()
+}
+
+func escapeMarkdownSegment(text string, lineStart bool) string {
+	lines := strings.Split(markdownEscaper.Replace(text), "\n")
+
+	for i, line := range lines {
+		if i == 0 && !lineStart {
+			continue
+		}
+
+		lines[i] = escapeLineStart(line)
+	}
+
+	return strings.Join(lines, "\n")
+}
+
+// escapeLineStart escapes anything which only has a special meaning at the
+// start of a line, such as headings, quotes and lists.
+func escapeLineStart(line string) string {
+	trimmed := strings.TrimLeft(line, " \t")
+	indent := line[:len(line)-len(trimmed)]
+
+	if trimmed == "" {
+		return line
+	}
+
+	switch trimmed[0] {
+	case '#', '>', '-', '+':
+		return indent + `\` + trimmed
+	}
+
+	if loc := orderedListRegexp.FindStringIndex(trimmed); loc != nil {
+		return indent + trimmed[:loc[1]-1] + `\` + trimmed[loc[1]-1:]
+	}
+
+	return line
+}
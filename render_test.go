@@ -0,0 +1,502 @@
+package seabird_discord
+
+import (
+	"math/rand"
+	"strings"
+	"testing"
+	"unicode"
+
+	"github.com/seabird-chat/seabird-go"
+	"github.com/seabird-chat/seabird-go/pb"
+
+	"github.com/stretchr/testify/assert"
+	"google.golang.org/protobuf/encoding/protojson"
+)
+
+func TestBlockToText(t *testing.T) {
+	var testCases = []struct {
+		name     string
+		input    *pb.Block
+		expected string
+	}{
+		// Simple Cases
+		{
+			name:     "text-simple",
+			input:    seabird.NewTextBlock("hello world"),
+			expected: "hello world",
+		},
+		{
+			name:     "text-escaped",
+			input:    seabird.NewTextBlock(`*hello* __world__ ||a|| ~~b~~ [c] \`),
+			expected: `\*hello\* \_\_world\_\_ \|\|a\|\| \~\~b\~\~ \[c\] \\`,
+		},
+		{
+			name:     "text-escaped-line-start",
+			input:    seabird.NewTextBlock("# hello\n> world\n- a\n1. b\nnot-start"),
+			expected: "\\# hello\n\\> world\n\\- a\n1\\. b\nnot-start",
+		},
+		{
+			name:     "text-url",
+			input:    seabird.NewTextBlock("see https://example.com/a_b_c for *details*"),
+			expected: `see https://example.com/a_b_c for \*details\*`,
+		},
+		{
+			name:     "italics-simple",
+			input:    seabird.NewItalicsBlock(seabird.NewTextBlock("hello world")),
+			expected: "*hello world*",
+		},
+		{
+			name:     "bold-simple",
+			input:    seabird.NewBoldBlock(seabird.NewTextBlock("hello world")),
+			expected: "**hello world**",
+		},
+		{
+			name:     "underline-simple",
+			input:    seabird.NewUnderlineBlock(seabird.NewTextBlock("hello world")),
+			expected: "__hello world__",
+		},
+		{
+			name:     "strikethrough-simple",
+			input:    seabird.NewStrikethroughBlock(seabird.NewTextBlock("hello world")),
+			expected: "~~hello world~~",
+		},
+		{
+			name:     "spoiler-simple",
+			input:    seabird.NewSpoilerBlock(seabird.NewTextBlock("hello world")),
+			expected: "||hello world||",
+		},
+		{
+			name:     "inline-code-simple",
+			input:    seabird.NewInlineCodeBlock("hello *world*"),
+			expected: "`hello *world*`",
+		},
+		{
+			name:     "inline-code-backticks",
+			input:    seabird.NewInlineCodeBlock("`hello` world"),
+			expected: "`` `hello` world ``",
+		},
+		{
+			name:     "fenced-code-simple",
+			input:    seabird.NewFencedCodeBlock("python", "print('hello world')"),
+			expected: "```python\nprint('hello world')\n```",
+		},
+		{
+			name:     "fenced-code-backticks",
+			input:    seabird.NewFencedCodeBlock("md", "```go\nfmt.Println()\n```"),
+			expected: "````md\n```go\nfmt.Println()\n```\n````",
+		},
+		{
+			name:     "link-simple",
+			input:    seabird.NewLinkBlock("https://seabird.chat", seabird.NewTextBlock("seabird")),
+			expected: "[seabird](https://seabird.chat)",
+		},
+		{
+			name:     "link-auto",
+			input:    seabird.NewLinkBlock("https://seabird.chat", seabird.NewTextBlock("https://seabird.chat")),
+			expected: "https://seabird.chat",
+		},
+		{
+			name:     "link-paren",
+			input:    seabird.NewLinkBlock("https://example.com/a)b", seabird.NewTextBlock("hello")),
+			expected: "[hello](<https://example.com/a)b>)",
+		},
+		{
+			name:     "link-auto-paren",
+			input:    seabird.NewLinkBlock("https://example.com/(a)", seabird.NewTextBlock("https://example.com/(a)")),
+			expected: "[https://example.com/(a)](<https://example.com/(a)>)",
+		},
+		{
+			name:     "heading-simple",
+			input:    seabird.NewHeadingBlock(1, seabird.NewTextBlock("hello")),
+			expected: "# hello",
+		},
+		{
+			name:     "heading-clamped",
+			input:    seabird.NewHeadingBlock(6, seabird.NewTextBlock("hello")),
+			expected: "### hello",
+		},
+		{
+			name:     "blockquote-simple",
+			input:    seabird.NewBlockquoteBlock(seabird.NewTextBlock("hello world")),
+			expected: "> hello world",
+		},
+		{
+			name: "list-simple",
+			input: seabird.NewListBlock(
+				seabird.NewTextBlock("hello"),
+				seabird.NewTextBlock("world"),
+			),
+			expected: "- hello\n- world",
+		},
+
+		// Complex Cases
+		{
+			name: "whitespace-outside-delimiters",
+			input: seabird.NewContainerBlock(
+				seabird.NewTextBlock("a"),
+				seabird.NewBoldBlock(seabird.NewTextBlock(" b ")),
+				seabird.NewTextBlock("c"),
+			),
+			expected: "a **b** c",
+		},
+		{
+			name: "bold-italics",
+			input: seabird.NewContainerBlock(
+				seabird.NewBoldBlock(seabird.NewItalicsBlock(seabird.NewTextBlock("a"))),
+				seabird.NewTextBlock(" "),
+				seabird.NewItalicsBlock(seabird.NewBoldBlock(seabird.NewTextBlock("b"))),
+			),
+			expected: "**_a_** ***b***",
+		},
+		{
+			name: "list-nested",
+			input: seabird.NewListBlock(
+				seabird.NewContainerBlock(
+					seabird.NewTextBlock("hello"),
+					seabird.NewListBlock(
+						seabird.NewTextBlock("world"),
+					),
+				),
+			),
+			expected: "- hello\n  - world",
+		},
+		{
+			name: "block-separators",
+			input: seabird.NewContainerBlock(
+				seabird.NewHeadingBlock(1, seabird.NewTextBlock("title")),
+				seabird.NewBlockquoteBlock(seabird.NewTextBlock("quote")),
+				seabird.NewTextBlock("after"),
+				seabird.NewFencedCodeBlock("", "code"),
+			),
+			expected: "# title\n> quote\n\nafter\n```\ncode\n```",
+		},
+		{
+			name: "why-we-cant-have-nice-things",
+			input: seabird.NewContainerBlock(
+				seabird.NewStrikethroughBlock(
+					seabird.NewTextBlock("strike "),
+					seabird.NewBoldBlock(
+						seabird.NewTextBlock("bold"),
+					),
+					seabird.NewTextBlock(" "),
+					seabird.NewItalicsBlock(
+						seabird.NewTextBlock("italic"),
+						seabird.NewUnderlineBlock(
+							seabird.NewTextBlock("under"),
+						),
+					),
+				),
+				seabird.NewTextBlock(" in "),
+				seabird.NewSpoilerBlock(
+					seabird.NewTextBlock("spoiled "),
+					seabird.NewBoldBlock(
+						seabird.NewTextBlock("bold"),
+					),
+				),
+			),
+			expected: "~~strike **bold** *italic__under__*~~ in ||spoiled **bold**||",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.name, func(t *testing.T) {
+			assert.Equal(t, testCase.expected, BlockToText(testCase.input))
+		})
+	}
+}
+
+// normalizeBlock flattens containers and merges adjacent text blocks, dropping
+// any which are empty. The parser splits text in places which don't matter (such as
+// around anything Linkify looks at) and paragraph breaks can't be represented
+// in a block tree, so we need to ignore these differences when comparing.
+// Similarly, bare URLs are treated as text because Discord displays them the
+// same either way.
+func normalizeBlock(block *pb.Block) *pb.Block {
+	if isEmptyBlock(block) {
+		return seabird.NewContainerBlock()
+	}
+
+	switch inner := block.Inner.(type) {
+	case *pb.Block_Container:
+		return maybeContainer(normalizeBlocks(inner.Container.Inner)...)
+	case *pb.Block_Italics:
+		return seabird.NewItalicsBlock(normalizeBlock(inner.Italics.Inner))
+	case *pb.Block_Bold:
+		return seabird.NewBoldBlock(normalizeBlock(inner.Bold.Inner))
+	case *pb.Block_Underline:
+		return seabird.NewUnderlineBlock(normalizeBlock(inner.Underline.Inner))
+	case *pb.Block_Strikethrough:
+		return seabird.NewStrikethroughBlock(normalizeBlock(inner.Strikethrough.Inner))
+	case *pb.Block_Spoiler:
+		return seabird.NewSpoilerBlock(normalizeBlock(inner.Spoiler.Inner))
+	case *pb.Block_Heading:
+		// Whitespace at the end of a heading isn't displayed, but depending on
+		// how the heading is closed, goldmark sometimes leaves it in.
+		heading := normalizeBlock(inner.Heading.Inner)
+		if text, ok := heading.Inner.(*pb.Block_Text); ok {
+			heading = seabird.NewTextBlock(strings.TrimRightFunc(text.Text.Text, unicode.IsSpace))
+		}
+		return seabird.NewHeadingBlock(int(inner.Heading.Level), heading)
+	case *pb.Block_Blockquote:
+		return seabird.NewBlockquoteBlock(normalizeBlock(inner.Blockquote.Inner))
+	case *pb.Block_Link:
+		if text, ok := inner.Link.Inner.GetInner().(*pb.Block_Text); ok && text.Text.Text == inner.Link.Url {
+			return seabird.NewTextBlock(inner.Link.Url)
+		}
+		return seabird.NewLinkBlock(inner.Link.Url, normalizeBlock(inner.Link.Inner))
+	case *pb.Block_List:
+		var items []*pb.Block
+		for _, item := range inner.List.Inner {
+			items = append(items, normalizeBlock(item))
+		}
+		return seabird.NewListBlock(items...)
+	default:
+		return block
+	}
+}
+
+func normalizeBlocks(blocks []*pb.Block) []*pb.Block {
+	var ret []*pb.Block
+
+	for _, block := range blocks {
+		block = normalizeBlock(block)
+
+		var flattened []*pb.Block
+		if container, ok := block.Inner.(*pb.Block_Container); ok {
+			flattened = container.Container.Inner
+		} else {
+			flattened = []*pb.Block{block}
+		}
+
+		for _, cur := range flattened {
+			if isEmptyBlock(cur) {
+				continue
+			}
+
+			if len(ret) > 0 {
+				prev, prevOk := ret[len(ret)-1].Inner.(*pb.Block_Text)
+				next, nextOk := cur.Inner.(*pb.Block_Text)
+				if prevOk && nextOk {
+					ret[len(ret)-1] = seabird.NewTextBlock(prev.Text.Text + next.Text.Text)
+					continue
+				}
+			}
+
+			ret = append(ret, cur)
+		}
+	}
+
+	return ret
+}
+
+// isEmptyBlock returns true if a block would not display anything.
+func isEmptyBlock(block *pb.Block) bool {
+	switch inner := block.Inner.(type) {
+	case *pb.Block_Text:
+		return inner.Text.Text == ""
+	case *pb.Block_Container:
+		return len(inner.Container.Inner) == 0
+	case *pb.Block_Italics:
+		return isEmptyBlock(inner.Italics.Inner)
+	case *pb.Block_Bold:
+		return isEmptyBlock(inner.Bold.Inner)
+	case *pb.Block_Underline:
+		return isEmptyBlock(inner.Underline.Inner)
+	case *pb.Block_Strikethrough:
+		return isEmptyBlock(inner.Strikethrough.Inner)
+	case *pb.Block_Spoiler:
+		return isEmptyBlock(inner.Spoiler.Inner)
+	default:
+		return false
+	}
+}
+
+// assertRoundTrip checks that parsing some text, rendering it and parsing it
+// again results in the same block tree.
+func assertRoundTrip(t *testing.T, input string) bool {
+	t.Helper()
+
+	first, isAction, err := TextToBlock(input)
+	if !assert.NoError(t, err) {
+		return false
+	}
+
+	rendered := BlockToText(first)
+	if isAction {
+		rendered = "_" + rendered + "_"
+	}
+
+	second, secondIsAction, err := TextToBlock(rendered)
+	if !assert.NoError(t, err) {
+		return false
+	}
+
+	expected, err := protojson.Marshal(normalizeBlock(first))
+	if !assert.NoError(t, err) {
+		return false
+	}
+
+	actual, err := protojson.Marshal(normalizeBlock(second))
+	if !assert.NoError(t, err) {
+		return false
+	}
+
+	return assert.Equal(t, isAction, secondIsAction, "rendered: %q", rendered) &&
+		assert.JSONEq(t, string(expected), string(actual), "rendered: %q", rendered)
+}
+
+// roundTripSeeds are inputs which exercise each of the parts of the parser
+// configuration we rely on.
+var roundTripSeeds = []string{
+	"hello world",
+	"*hello world*",
+	"**hello world**",
+	"***hello world***",
+	"**_hello_ world**",
+	"*hello **world***",
+	"start __hello world__ end",
+	"||hello world||",
+	"~~hello world~~",
+	"~~strike **bold** _italic__under___~~ in ||spoiled **bold**||",
+	"~a~ ~hello~ ~~~world~~~ ~~~~~asdf~~~~~",
+	"|a| |hello| |||world||| |||||asdf|||||",
+	"*a* *hello* ***world*** *****asdf*****",
+	"__||~~nested~~||__",
+	"`hello world`",
+	"``hello `world` ``",
+	"[hello](world)",
+	"[hello](<https://example.com/a)b>)",
+	"[hello](<https://example.com/a(b>)",
+	"[wiki](https://en.wikipedia.org/wiki/Foo_(bar))",
+	"hello https://seabird.chat",
+	"```python\nprint('hello world')\n```",
+	"```\n**not bold**\n> not quoted\n```\nafter",
+	"````\n```go\nnested\n```\n````",
+	"````\ninline ``` fence\n````",
+	"> hello world",
+	"> hello **world**\n>\n> post-blank",
+	"> quote\n\nafter",
+	"# 1\n## 2\n### 3\n#### 4",
+	"* hello\n* world",
+	"* hello\n  * world\n    1. ordered\n    2. list",
+	`\*escaped\* \_\_text\_\_ \|\|here\|\| \~\~too\~\~`,
+	`back\\slash`,
+	"_hello world_",
+	"_action with *emphasis*_",
+}
+
+func TestRoundTripSeeds(t *testing.T) {
+	for _, input := range roundTripSeeds {
+		t.Run(input, func(t *testing.T) {
+			assertRoundTrip(t, input)
+		})
+	}
+}
+
+// TestRoundTripGenerated builds random messages out of the markup Discord
+// supports and makes sure they survive a round trip.
+func TestRoundTripGenerated(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for i := 0; i < 2000; i++ {
+		input := generateMarkdown(r)
+		if !assertRoundTrip(t, input) {
+			t.Logf("input: %q", input)
+			return
+		}
+	}
+}
+
+// FuzzRoundTrip uses the fuzzer to pick seeds for the markdown generator.
+// Completely arbitrary input isn't useful here, as CommonMark emphasis rules
+// make many inputs ambiguous in ways Discord doesn't care about.
+func FuzzRoundTrip(f *testing.F) {
+	for seed := int64(0); seed < 10; seed++ {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, seed int64) {
+		input := generateMarkdown(rand.New(rand.NewSource(seed)))
+		if !assertRoundTrip(t, input) {
+			t.Logf("input: %q", input)
+		}
+	})
+}
+
+var (
+	// NOTE: bare delimiter characters and backslashes are left out of the
+	// generated words, because when they end up next to a real delimiter,
+	// CommonMark and Discord disagree on how they should be parsed. Escaping
+	// of these is covered by the seeds instead.
+	generatedWords = []string{
+		"hello", "world", "seabird", "a", "1", "#", ">", "-", "[x]", "(y)",
+		"https://seabird.chat",
+	}
+	generatedInline = []string{"*", "**", "__", "~~", "||"}
+)
+
+func generateMarkdown(r *rand.Rand) string {
+	var blocks []string
+
+	for n := r.Intn(3) + 1; n > 0; n-- {
+		switch r.Intn(6) {
+		case 0:
+			blocks = append(blocks, "> "+generateInline(r, "", 2))
+		case 1:
+			blocks = append(blocks, "```go\n"+generateWords(r)+"\n```")
+		case 2:
+			blocks = append(blocks, strings.Repeat("#", r.Intn(3)+1)+" "+generateInline(r, "", 1))
+		case 3:
+			blocks = append(blocks, "- "+generateInline(r, "", 1)+"\n- "+generateInline(r, "", 1))
+		default:
+			// Paragraphs get a prefix so they can't accidentally turn into
+			// another block type, like a list.
+			blocks = append(blocks, "p "+generateInline(r, "", 3))
+		}
+	}
+
+	return strings.Join(blocks, "\n\n")
+}
+
+// generateInline generates inline markup. To avoid ambiguous input like
+// "****a** b**", delimiters are never nested directly inside a delimiter using
+// the same character.
+func generateInline(r *rand.Rand, parentDelim string, depth int) string {
+	var parts []string
+
+	for n := r.Intn(3) + 1; n > 0; n-- {
+		if depth <= 0 {
+			parts = append(parts, generateWords(r))
+			continue
+		}
+
+		switch r.Intn(4) {
+		case 0:
+			delim := generatedInline[r.Intn(len(generatedInline))]
+			if parentDelim != "" && delim[0] == parentDelim[0] {
+				parts = append(parts, generateWords(r))
+				continue
+			}
+
+			parts = append(parts, delim+generateInline(r, delim, depth-1)+delim)
+		case 1:
+			parts = append(parts, "`"+generateWords(r)+"`")
+		case 2:
+			parts = append(parts, "["+generateInline(r, parentDelim, depth-1)+"](https://example.com)")
+		default:
+			parts = append(parts, generateWords(r))
+		}
+	}
+
+	return strings.Join(parts, " ")
+}
+
+func generateWords(r *rand.Rand) string {
+	var words []string
+
+	for n := r.Intn(3) + 1; n > 0; n-- {
+		words = append(words, generatedWords[r.Intn(len(generatedWords))])
+	}
+
+	return strings.Join(words, " ")
+}
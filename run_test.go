@@ -0,0 +1,440 @@
+package seabird_discord
+
+import (
+	"context"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"github.com/seabird-chat/seabird-go/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/seabird-chat/seabird-discord-backend/internal/fakediscord"
+	"github.com/seabird-chat/seabird-discord-backend/internal/fakeseabird"
+)
+
+const testTimeout = 5 * time.Second
+
+// runTestBackend runs a backend connected to both a fake Discord and a fake
+// seabird-core until the test finishes.
+func runTestBackend(t *testing.T, config DiscordConfig) (*Backend, *fakediscord.Server, *fakeseabird.Server) {
+	core, err := fakeseabird.New()
+	require.NoError(t, err)
+	t.Cleanup(core.Close)
+
+	b, discord := startTestBackend(t, config, core)
+	require.NoError(t, core.WaitForConnection(1, testTimeout))
+
+	return b, discord, core
+}
+
+// startTestBackend runs a backend against the given fake seabird-core until
+// the test finishes. It only waits for the Discord session to connect.
+func startTestBackend(t *testing.T, config DiscordConfig, core *fakeseabird.Server) (*Backend, *fakediscord.Server) {
+	discord := fakediscord.New()
+	t.Cleanup(discord.Close)
+
+	config.Logger = zerolog.Nop()
+	config.DiscordToken = "discord-token"
+	config.SeabirdHost = core.URL()
+	config.SeabirdToken = "seabird-token"
+
+	b, err := New(config)
+	require.NoError(t, err)
+
+	b.discord.Client.Transport = discord.Transport()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errs := make(chan error, 1)
+	go func() { errs <- b.RunContext(ctx) }()
+
+	t.Cleanup(func() {
+		cancel()
+		select {
+		case err := <-errs:
+			assert.ErrorIs(t, err, context.Canceled)
+		case <-time.After(testTimeout):
+			t.Error("timed out waiting for backend to stop")
+		}
+	})
+
+	require.NoError(t, discord.WaitForSession(testTimeout))
+
+	return b, discord
+}
+
+func isMessage(text string) func(*pb.ChatEvent) bool {
+	return func(e *pb.ChatEvent) bool {
+		msg := e.GetMessage()
+		return msg != nil && msg.GetRootBlock() != nil && blockText(msg.GetRootBlock()) == text
+	}
+}
+
+func isResult(id string) func(*pb.ChatEvent) bool {
+	return func(e *pb.ChatEvent) bool {
+		return e.GetSuccess() != nil && e.Id == id || e.GetFailed() != nil && e.Id == id
+	}
+}
+
+// blockText flattens the text in a block, ignoring formatting.
+func blockText(block *pb.Block) string {
+	if text := block.GetText(); text != nil {
+		return text.Text
+	}
+
+	var ret string
+	for _, inner := range block.GetContainer().GetInner() {
+		ret += blockText(inner)
+	}
+	return ret
+}
+
+func TestRunEndToEnd(t *testing.T) {
+	config := DefaultConfig()
+	config.ReconnectBackoff = BackoffConfig{Min: 10 * time.Millisecond, Max: 50 * time.Millisecond}
+	config.VoiceChannels = map[string]string{"20": "10"}
+
+	_, discord, core := runTestBackend(t, config)
+
+	hello := core.Events()[0].GetHello()
+	require.NotNil(t, hello)
+	assert.Equal(t, "discord", hello.BackendInfo.Type)
+	assert.Equal(t, "seabird", hello.BackendInfo.Id)
+
+	guild := *testGuild
+	guild.Channels = append(guild.Channels, &discordgo.Channel{
+		ID: "20", GuildID: "1", Name: "voice", Type: discordgo.ChannelTypeGuildVoice,
+	})
+	require.NoError(t, discord.Dispatch("GUILD_CREATE", &guild))
+
+	_, err := core.WaitForEvent(func(e *pb.ChatEvent) bool {
+		return e.GetJoinChannel().GetChannelId() == "10"
+	}, testTimeout)
+	require.NoError(t, err)
+
+	require.NoError(t, discord.Dispatch("MESSAGE_CREATE", &discordgo.Message{
+		ID:        "100",
+		ChannelID: "10",
+		GuildID:   "1",
+		Content:   "hello seabird",
+		Author:    testUser,
+	}))
+
+	message, err := core.WaitForEvent(isMessage("hello seabird"), testTimeout)
+	require.NoError(t, err)
+	assert.Equal(t, "10", message.GetMessage().Source.ChannelId)
+
+	// Requests are acknowledged once they've been sent to Discord.
+	require.NoError(t, core.SendRequest(&pb.ChatRequest{
+		Id: "req-1",
+		Inner: &pb.ChatRequest_SendMessage{SendMessage: &pb.SendMessageChatRequest{
+			ChannelId: "10",
+			Text:      "hello from seabird",
+		}},
+	}))
+
+	req, err := discord.WaitForRequest("POST", "/channels/10/messages", testTimeout)
+	require.NoError(t, err)
+	assert.Contains(t, string(req.Body), "hello from seabird")
+
+	result, err := core.WaitForEvent(isResult("req-1"), testTimeout)
+	require.NoError(t, err)
+	assert.NotNil(t, result.GetSuccess())
+
+	// Requests for the same channel are sent and acknowledged in the order
+	// they were received.
+	ids := []string{"req-a", "req-b", "req-c"}
+	for _, id := range ids {
+		require.NoError(t, core.SendRequest(&pb.ChatRequest{
+			Id: id,
+			Inner: &pb.ChatRequest_SendMessage{SendMessage: &pb.SendMessageChatRequest{
+				ChannelId: "10",
+				Text:      id,
+			}},
+		}))
+	}
+
+	_, err = core.WaitForEvent(isResult("req-c"), testTimeout)
+	require.NoError(t, err)
+
+	var acked []string
+	for _, e := range core.Events() {
+		if e.GetSuccess() != nil && strings.HasPrefix(e.Id, "req-") && e.Id != "req-1" {
+			acked = append(acked, e.Id)
+		}
+	}
+	assert.Equal(t, ids, acked)
+
+	var sent []string
+	for _, req := range discord.Requests() {
+		var msg discordgo.MessageSend
+		if req.Method == "POST" && req.Decode(&msg) == nil && strings.HasPrefix(msg.Content, "req-") {
+			sent = append(sent, msg.Content)
+		}
+	}
+	assert.Equal(t, ids, sent)
+
+	// Joining a mapped voice channel is announced through the Seabird service.
+	require.NoError(t, discord.Dispatch("VOICE_STATE_UPDATE", &discordgo.VoiceState{
+		GuildID:   "1",
+		ChannelID: "20",
+		UserID:    testUser.ID,
+	}))
+
+	require.Eventually(t, func() bool { return len(core.Messages()) > 0 }, testTimeout, 10*time.Millisecond)
+	assert.Equal(t, "10", core.Messages()[0].ChannelId)
+	assert.Contains(t, core.Messages()[0].Text, "has joined voice channel")
+
+	// If the stream drops, the backend reconnects and carries on.
+	core.DropStream()
+	require.NoError(t, core.WaitForConnection(2, testTimeout))
+
+	require.NoError(t, core.SendRequest(&pb.ChatRequest{
+		Id: "req-2",
+		Inner: &pb.ChatRequest_UpdateChannelInfo{UpdateChannelInfo: &pb.UpdateChannelInfoChatRequest{
+			ChannelId: "10",
+			Topic:     "new topic",
+		}},
+	}))
+
+	result, err = core.WaitForEvent(isResult("req-2"), testTimeout)
+	require.NoError(t, err)
+	assert.NotNil(t, result.GetSuccess())
+
+	req, err = discord.WaitForRequest("PATCH", "/channels/10", testTimeout)
+	require.NoError(t, err)
+	assert.Contains(t, string(req.Body), "new topic")
+}
+
+func TestRunRejectedStream(t *testing.T) {
+	core, err := fakeseabird.New()
+	require.NoError(t, err)
+	t.Cleanup(core.Close)
+
+	// The stream is accepted when it's opened, but seabird-core ends it as
+	// soon as it sees the hello.
+	core.Reject(status.Error(codes.Unauthenticated, "invalid token"))
+
+	config := DefaultConfig()
+	config.ReconnectBackoff = BackoffConfig{Min: 10 * time.Millisecond, Max: time.Hour, Factor: 2}
+
+	b, _ := startTestBackend(t, config, core)
+
+	attempts := func() int {
+		b.reconnect.lock.Lock()
+		defer b.reconnect.lock.Unlock()
+		return b.reconnect.attempt
+	}
+
+	// Each rejected stream is a failed attempt, so the delay keeps growing
+	// rather than starting over at the minimum every time.
+	require.NoError(t, core.WaitForAttempts(4, testTimeout))
+	assert.GreaterOrEqual(t, attempts(), 3)
+	assert.Zero(t, core.Connections())
+
+	state, _ := b.IngestState()
+	assert.NotEqual(t, ConnStateConnected, state)
+
+	// Once a stream is accepted and a request arrives on it, the backoff
+	// starts over.
+	core.Reject(nil)
+	require.NoError(t, core.WaitForConnection(1, testTimeout))
+	require.NoError(t, core.SendRequest(&pb.ChatRequest{
+		Id: "req-1",
+		Inner: &pb.ChatRequest_LeaveChannel{LeaveChannel: &pb.LeaveChannelChatRequest{
+			ChannelId: "10",
+		}},
+	}))
+
+	_, err = core.WaitForEvent(isResult("req-1"), testTimeout)
+	require.NoError(t, err)
+
+	state, _ = b.IngestState()
+	assert.Equal(t, ConnStateConnected, state)
+	assert.Zero(t, attempts())
+}
+
+func TestRunQueueRejectedStream(t *testing.T) {
+	core, err := fakeseabird.New()
+	require.NoError(t, err)
+	t.Cleanup(core.Close)
+
+	core.Reject(status.Error(codes.Unauthenticated, "invalid token"))
+
+	config := DefaultConfig()
+	config.ReconnectBackoff = BackoffConfig{Min: 10 * time.Millisecond, Max: 20 * time.Millisecond}
+	config.EventQueuePath = filepath.Join(t.TempDir(), "queue")
+
+	b, discord := startTestBackend(t, config, core)
+
+	require.NoError(t, discord.Dispatch("GUILD_CREATE", testGuild))
+
+	texts := []string{"one", "two", "three", "four", "five"}
+	for i, text := range texts {
+		require.NoError(t, discord.Dispatch("MESSAGE_CREATE", &discordgo.Message{
+			ID:        strconv.Itoa(100 + i),
+			ChannelID: "10",
+			GuildID:   "1",
+			Content:   text,
+			Author:    testUser,
+		}))
+	}
+
+	// The join and the messages are queued, and stay queued while every
+	// stream is rejected.
+	require.Eventually(t, func() bool {
+		return b.EventStats().QueueLength == len(texts)+1
+	}, testTimeout, 10*time.Millisecond)
+
+	require.NoError(t, core.WaitForAttempts(core.Attempts()+3, testTimeout))
+	assert.Equal(t, len(texts)+1, b.EventStats().QueueLength)
+	assert.Zero(t, b.EventStats().Replayed)
+
+	// Once a stream is accepted and confirmed, everything is replayed.
+	core.Reject(nil)
+	require.NoError(t, core.WaitForConnection(1, testTimeout))
+	require.NoError(t, core.SendRequest(&pb.ChatRequest{
+		Id: "req-1",
+		Inner: &pb.ChatRequest_UpdateChannelInfo{UpdateChannelInfo: &pb.UpdateChannelInfoChatRequest{
+			ChannelId: "10",
+			Topic:     "new topic",
+		}},
+	}))
+
+	for _, text := range texts {
+		_, err := core.WaitForEvent(isMessage(text), testTimeout)
+		require.NoError(t, err, text)
+	}
+
+	assert.Zero(t, b.EventStats().QueueLength)
+	assert.Equal(t, uint64(len(texts)+1), b.EventStats().Replayed)
+}
+
+func TestRunUpdateChannelInfo(t *testing.T) {
+	_, discord, core := runTestBackend(t, DefaultConfig())
+
+	require.NoError(t, discord.Dispatch("GUILD_CREATE", testGuild))
+
+	require.NoError(t, core.SendRequest(&pb.ChatRequest{
+		Id: "req-1",
+		Inner: &pb.ChatRequest_UpdateChannelInfo{UpdateChannelInfo: &pb.UpdateChannelInfoChatRequest{
+			ChannelId: "10",
+			Topic:     "new topic",
+		}},
+	}))
+
+	result, err := core.WaitForEvent(isResult("req-1"), testTimeout)
+	require.NoError(t, err)
+	assert.NotNil(t, result.GetSuccess())
+
+	req, err := discord.WaitForRequest("PATCH", "/channels/{channel}", testTimeout)
+	require.NoError(t, err)
+	assert.Equal(t, "/api/v9/channels/10", req.Path)
+
+	var edit discordgo.ChannelEdit
+	require.NoError(t, req.Decode(&edit))
+	assert.Equal(t, "new topic", edit.Topic)
+
+	// If Discord rejects the change, the request fails.
+	discord.Handle("PATCH", "/channels/{channel}", func(req fakediscord.Request, params map[string]string) (interface{}, error) {
+		return nil, &fakediscord.Error{Status: 403, Code: 50013, Message: "Missing Permissions"}
+	})
+
+	require.NoError(t, core.SendRequest(&pb.ChatRequest{
+		Id: "req-2",
+		Inner: &pb.ChatRequest_UpdateChannelInfo{UpdateChannelInfo: &pb.UpdateChannelInfoChatRequest{
+			ChannelId: "10",
+			Topic:     "another topic",
+		}},
+	}))
+
+	result, err = core.WaitForEvent(isResult("req-2"), testTimeout)
+	require.NoError(t, err)
+	assert.NotNil(t, result.GetFailed())
+}
+
+func TestRunJoinLeaveChannel(t *testing.T) {
+	_, discord, core := runTestBackend(t, DefaultConfig())
+
+	guild := *testGuild
+	guild.Channels = append(guild.Channels, &discordgo.Channel{
+		ID: "20", GuildID: "1", Name: "voice", Type: discordgo.ChannelTypeGuildVoice,
+	})
+	require.NoError(t, discord.Dispatch("GUILD_CREATE", &guild))
+	require.NoError(t, discord.Dispatch("THREAD_CREATE", &discordgo.Channel{
+		ID: "12", GuildID: "1", ParentID: "10", Name: "thread", Type: discordgo.ChannelTypeGuildPublicThread,
+	}))
+
+	_, err := core.WaitForEvent(func(e *pb.ChatEvent) bool {
+		return e.GetJoinChannel().GetChannelId() == "12"
+	}, testTimeout)
+	require.NoError(t, err)
+
+	leave := func(id, channelID string) *pb.ChatEvent {
+		require.NoError(t, core.SendRequest(&pb.ChatRequest{
+			Id: id,
+			Inner: &pb.ChatRequest_LeaveChannel{LeaveChannel: &pb.LeaveChannelChatRequest{
+				ChannelId: channelID,
+			}},
+		}))
+
+		result, err := core.WaitForEvent(isResult(id), testTimeout)
+		require.NoError(t, err)
+		return result
+	}
+
+	// Text channels and threads can be left.
+	assert.NotNil(t, leave("req-1", "10").GetSuccess())
+	assert.NotNil(t, leave("req-2", "12").GetSuccess())
+
+	for _, channelID := range []string{"10", "12"} {
+		_, err = core.WaitForEvent(func(e *pb.ChatEvent) bool {
+			return e.GetLeaveChannel().GetChannelId() == channelID
+		}, testTimeout)
+		require.NoError(t, err)
+	}
+
+	// Anything else is rejected rather than added to the muted channels.
+	assert.NotNil(t, leave("req-3", "20").GetFailed())
+	assert.NotNil(t, leave("req-4", "99").GetFailed())
+
+	join := func(id, channelName string) *pb.ChatEvent {
+		require.NoError(t, core.SendRequest(&pb.ChatRequest{
+			Id: id,
+			Inner: &pb.ChatRequest_JoinChannel{JoinChannel: &pb.JoinChannelChatRequest{
+				ChannelName: channelName,
+			}},
+		}))
+
+		result, err := core.WaitForEvent(isResult(id), testTimeout)
+		require.NoError(t, err)
+		return result
+	}
+
+	// Channels which were left can be joined again by name.
+	assert.NotNil(t, join("req-5", "general").GetSuccess())
+
+	// Joining by ID has the same checks as leaving.
+	require.NoError(t, discord.Dispatch("CHANNEL_CREATE", &discordgo.Channel{
+		ID: "30", Type: discordgo.ChannelTypeDM, Recipients: []*discordgo.User{testUser},
+	}))
+
+	assert.NotNil(t, join("req-6", "20").GetFailed())
+	assert.NotNil(t, join("req-7", "30").GetFailed())
+	assert.NotNil(t, join("req-8", "99").GetFailed())
+
+	var joins int
+	for _, e := range core.Events() {
+		if e.GetJoinChannel().GetChannelId() == "10" {
+			joins++
+		}
+	}
+	assert.Equal(t, 2, joins)
+}
@@ -0,0 +1,58 @@
+package seabird_discord
+
+import (
+	"github.com/bwmarrin/discordgo"
+)
+
+// Session is the subset of a Discord session which the backend uses outside
+// of connecting to the gateway. Everything other than the gateway connection
+// goes through this, so handlers can be tested against a fake, and so
+// messages can be sent by other means.
+type Session interface {
+	// State is the cache of everything received from the gateway. Fakes can
+	// build one with discordgo.NewState.
+	State() *discordgo.State
+
+	// BotUserID returns the ID of the user we're logged in as.
+	BotUserID() string
+
+	Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelEditComplex(channelID string, data *discordgo.ChannelEdit, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+	ChannelMessageSendComplex(channelID string, data *discordgo.MessageSend, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	UserChannelCreate(recipientID string, options ...discordgo.RequestOption) (*discordgo.Channel, error)
+
+	ChannelWebhooks(channelID string, options ...discordgo.RequestOption) ([]*discordgo.Webhook, error)
+	Webhook(webhookID string, options ...discordgo.RequestOption) (*discordgo.Webhook, error)
+	WebhookCreate(channelID, name, avatar string, options ...discordgo.RequestOption) (*discordgo.Webhook, error)
+	WebhookExecute(webhookID, token string, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	WebhookThreadExecute(webhookID, token string, wait bool, threadID string, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error)
+
+	ApplicationCommandBulkOverwrite(appID string, guildID string, commands []*discordgo.ApplicationCommand, options ...discordgo.RequestOption) ([]*discordgo.ApplicationCommand, error)
+	InteractionRespond(interaction *discordgo.Interaction, resp *discordgo.InteractionResponse, options ...discordgo.RequestOption) error
+	InteractionResponseEdit(interaction *discordgo.Interaction, newresp *discordgo.WebhookEdit, options ...discordgo.RequestOption) (*discordgo.Message, error)
+	InteractionResponseDelete(interaction *discordgo.Interaction, options ...discordgo.RequestOption) error
+	FollowupMessageCreate(interaction *discordgo.Interaction, wait bool, data *discordgo.WebhookParams, options ...discordgo.RequestOption) (*discordgo.Message, error)
+}
+
+// discordSession adapts a discordgo session to the Session interface. The REST
+// methods are promoted from the embedded session.
+type discordSession struct {
+	*discordgo.Session
+}
+
+var _ Session = discordSession{}
+
+func (s discordSession) State() *discordgo.State {
+	return s.Session.State
+}
+
+func (s discordSession) BotUserID() string {
+	s.Session.State.RLock()
+	defer s.Session.State.RUnlock()
+
+	if s.Session.State.User == nil {
+		return ""
+	}
+
+	return s.Session.State.User.ID
+}
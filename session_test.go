@@ -0,0 +1,111 @@
+package seabird_discord
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog"
+	"github.com/seabird-chat/seabird-go/pb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeSession is a Session backed only by a state cache. Any REST call which
+// isn't overridden will panic.
+type fakeSession struct {
+	Session
+
+	state    *discordgo.State
+	channels map[string]*discordgo.Channel
+}
+
+func newFakeSession(t *testing.T, guilds ...*discordgo.Guild) *fakeSession {
+	state := discordgo.NewState()
+	state.User = &discordgo.User{ID: "1000", Username: "seabird", Bot: true}
+
+	for _, g := range guilds {
+		require.NoError(t, state.GuildAdd(g))
+	}
+
+	return &fakeSession{
+		state:    state,
+		channels: make(map[string]*discordgo.Channel),
+	}
+}
+
+func (s *fakeSession) State() *discordgo.State { return s.state }
+
+func (s *fakeSession) BotUserID() string { return s.state.User.ID }
+
+func (s *fakeSession) Channel(channelID string, options ...discordgo.RequestOption) (*discordgo.Channel, error) {
+	if c, ok := s.channels[channelID]; ok {
+		return c, nil
+	}
+
+	return nil, discordgo.ErrStateNotFound
+}
+
+func TestComesFromDM(t *testing.T) {
+	s := newFakeSession(t, testGuild)
+	s.channels["20"] = &discordgo.Channel{ID: "20", Type: discordgo.ChannelTypeDM}
+
+	fromDM, err := ComesFromDM(s, &discordgo.MessageCreate{Message: &discordgo.Message{ChannelID: "10"}})
+	require.NoError(t, err)
+	assert.False(t, fromDM)
+
+	// Channels missing from the state are looked up.
+	fromDM, err = ComesFromDM(s, &discordgo.MessageCreate{Message: &discordgo.Message{ChannelID: "20"}})
+	require.NoError(t, err)
+	assert.True(t, fromDM)
+
+	_, err = ComesFromDM(s, &discordgo.MessageCreate{Message: &discordgo.Message{ChannelID: "30"}})
+	assert.Error(t, err)
+}
+
+func TestReplaceMentions(t *testing.T) {
+	guild := *testGuild
+	guild.Emojis = []*discordgo.Emoji{{ID: "50", Name: "party"}}
+	s := newFakeSession(t, &guild)
+
+	text := ReplaceMentions(zerolog.Nop(), s, &discordgo.Message{
+		GuildID:   "1",
+		ChannelID: "10",
+		Content:   "hi <@2> in <#10> <:party:50>",
+		Mentions:  []*discordgo.User{testUser},
+	})
+	assert.Equal(t, "hi @alice in #general :party:", text)
+
+	// Private messages don't have a guild to look up, so there's nothing to
+	// warn about.
+	var logs bytes.Buffer
+	text = ReplaceMentions(zerolog.New(&logs), s, &discordgo.Message{
+		ChannelID: "20",
+		Content:   "hi <@2> <:party:50>",
+		Mentions:  []*discordgo.User{testUser},
+	})
+	assert.Equal(t, "hi @alice <:party:50>", text)
+	assert.Empty(t, logs.String())
+}
+
+func TestHandleMessageFakeSession(t *testing.T) {
+	config := DefaultConfig()
+	config.Logger = zerolog.Nop()
+
+	b, err := newBackend(config)
+	require.NoError(t, err)
+	b.session = newFakeSession(t, testGuild)
+
+	b.handleMessage(&discordgo.Message{
+		ID:        "100",
+		GuildID:   "1",
+		ChannelID: "10",
+		Author:    testUser,
+		Content:   "<@1000> !hello world",
+	}, false)
+
+	e := nextEvent(t, b)
+	require.IsType(t, &pb.ChatEvent_Mention{}, e.Inner)
+	assert.Equal(t, "10", e.GetMention().Source.ChannelId)
+	assert.Equal(t, "100", e.Tags[TagMessageID])
+}
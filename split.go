@@ -0,0 +1,323 @@
+package seabird_discord
+
+import (
+	"strings"
+	"unicode/utf8"
+)
+
+// maxMessageLength is the longest message Discord will accept.
+const maxMessageLength = 2000
+
+// splitMessage breaks text into chunks of at most limit characters. Splits
+// happen on line boundaries where possible, falling back to word boundaries
+// and finally to cutting a word if nothing else fits. Any open code fence is
+// closed at the end of a chunk and reopened at the start of the next one.
+func splitMessage(text string, limit int) []string {
+	if utf8.RuneCountInString(text) <= limit {
+		return []string{text}
+	}
+
+	s := &messageSplitter{limit: limit}
+	for _, line := range strings.Split(text, "\n") {
+		s.addLine(line)
+	}
+	s.flush()
+
+	return s.chunks
+}
+
+// messageChunks returns the messages which need to be sent to Discord for a
+// message or action. Actions are wrapped in italics.
+func messageChunks(text string, action bool) []string {
+	if !action {
+		return splitMessage(text, maxMessageLength)
+	}
+
+	// Each run of text around a code block is wrapped separately, so we need
+	// to leave room for the delimiters around all of them.
+	limit := maxMessageLength - 2*(countCodeBlocks(text)+1)
+
+	chunks := splitMessage(text, limit)
+	for i, chunk := range chunks {
+		chunks[i] = italicizeAction(chunk)
+	}
+
+	return chunks
+}
+
+// countCodeBlocks returns how many fenced code blocks text contains.
+func countCodeBlocks(text string) int {
+	var count int
+	var fence string
+	for _, line := range strings.Split(text, "\n") {
+		if fence == "" && fenceMarker(line) != "" {
+			fence = line
+			count++
+		} else if fence != "" && closesFence(fence, line) {
+			fence = ""
+		}
+	}
+
+	return count
+}
+
+// italicizeAction wraps the text of an action in italics. Code blocks can't be
+// italicized, and wrapping them would stop the fences from being recognized,
+// so any text around them is wrapped separately.
+func italicizeAction(text string) string {
+	var lines, run []string
+	flush := func() {
+		if len(run) > 0 {
+			lines = append(lines, wrapEmphasis("_", strings.Join(run, "\n")))
+			run = nil
+		}
+	}
+
+	var fence string
+	for _, line := range strings.Split(text, "\n") {
+		switch {
+		case fence == "" && fenceMarker(line) != "":
+			flush()
+			fence = line
+		case fence != "":
+			if closesFence(fence, line) {
+				fence = ""
+			}
+		default:
+			run = append(run, line)
+			continue
+		}
+
+		lines = append(lines, line)
+	}
+	flush()
+
+	return strings.Join(lines, "\n")
+}
+
+type messageSplitter struct {
+	limit  int
+	chunks []string
+
+	buf        strings.Builder
+	bufLen     int
+	hasContent bool
+
+	// fence is the line which opened the current code block, or empty if
+	// we're not in one.
+	fence string
+
+	// fenceOnly is set if the last line in buf opened a code block.
+	// lastLine and lastLineLen are where the last line starts, in bytes and
+	// characters.
+	fenceOnly   bool
+	lastLine    int
+	lastLineLen int
+}
+
+// fenceMarker returns the backticks which start a line if it's a code fence,
+// or an empty string if it isn't one.
+func fenceMarker(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	n := len(trimmed) - len(strings.TrimLeft(trimmed, "`"))
+	if n < 3 {
+		return ""
+	}
+
+	return trimmed[:n]
+}
+
+// closesFence returns true if line ends the code block opened by fence. The
+// closing fence has to be at least as long as the opening one, so code blocks
+// can contain shorter fences.
+func closesFence(fence, line string) bool {
+	marker := fenceMarker(line)
+	return marker != "" && len(marker) >= len(fenceMarker(fence)) && strings.TrimSpace(line) == marker
+}
+
+func (s *messageSplitter) addLine(line string) {
+	opening := s.fence == "" && fenceMarker(line) != ""
+
+	nextFence := s.fence
+	if s.fence == "" && fenceMarker(line) != "" {
+		nextFence = line
+	} else if s.fence != "" && closesFence(s.fence, line) {
+		nextFence = ""
+	}
+
+	// If we'll be in a code block after this line, we need to leave room to
+	// close it.
+	reserve := 0
+	if nextFence != "" {
+		reserve = len("\n" + fenceMarker(nextFence))
+	}
+
+	for {
+		sep := 0
+		if s.bufLen > 0 {
+			sep = 1
+		}
+
+		lineLen := utf8.RuneCountInString(line)
+		if s.bufLen+sep+lineLen+reserve <= s.limit {
+			s.write(line, lineLen)
+			break
+		}
+
+		// If the chunk ends with the start of a code block, flushing now
+		// would send an empty one, so the fence is moved to the next chunk.
+		if s.fenceOnly {
+			s.moveFence()
+			continue
+		}
+
+		// If there's already something in this chunk, start a new one and try
+		// again.
+		if s.hasContent {
+			closing := s.fence != "" && nextFence == ""
+			s.flush()
+
+			// If this line was closing the code block, the flush already did
+			// that for us, so we don't want to reopen it.
+			if closing {
+				s.buf.Reset()
+				s.bufLen = 0
+				break
+			}
+
+			continue
+		}
+
+		// Otherwise, the line is too long for a chunk on its own, so we need
+		// to split it.
+		piece, rest := cutLine(line, s.limit-s.bufLen-sep-reserve, nextFence != "" || s.fence != "")
+		s.write(piece, utf8.RuneCountInString(piece))
+		s.flush()
+		line = rest
+	}
+
+	s.fence = nextFence
+	s.fenceOnly = opening
+}
+
+// moveFence removes the line which opened the current code block from the end
+// of the chunk, flushes anything before it and starts the next chunk with it.
+func (s *messageSplitter) moveFence() {
+	before := s.buf.String()[:s.lastLine]
+	fence := s.fence
+
+	s.buf.Reset()
+	s.buf.WriteString(before)
+	s.bufLen = s.lastLineLen
+	s.hasContent = s.bufLen > 0
+	s.fenceOnly = false
+
+	s.fence = ""
+	s.flush()
+
+	s.fence = fence
+	s.buf.WriteString(fence)
+	s.bufLen = utf8.RuneCountInString(fence)
+}
+
+func (s *messageSplitter) write(line string, lineLen int) {
+	s.lastLine = s.buf.Len()
+	s.lastLineLen = s.bufLen
+	s.fenceOnly = false
+
+	if s.bufLen > 0 {
+		s.buf.WriteByte('\n')
+		s.bufLen++
+	}
+
+	s.buf.WriteString(line)
+	s.bufLen += lineLen
+	s.hasContent = true
+}
+
+// flush ends the current chunk. If we're in a code block, it is closed and
+// reopened in the next chunk.
+func (s *messageSplitter) flush() {
+	if !s.hasContent {
+		return
+	}
+
+	if s.fence != "" {
+		s.buf.WriteString("\n" + fenceMarker(s.fence))
+	}
+
+	s.chunks = append(s.chunks, s.buf.String())
+	s.buf.Reset()
+	s.bufLen = 0
+	s.hasContent = false
+
+	if s.fence != "" {
+		s.buf.WriteString(s.fence)
+		s.bufLen = utf8.RuneCountInString(s.fence)
+	}
+}
+
+// cutLine splits a line so the first part is at most limit characters. It
+// prefers splitting at a space where no inline formatting is left open. In
+// code, formatting doesn't matter, so any space will do.
+func cutLine(line string, limit int, inCode bool) (string, string) {
+	runes := []rune(line)
+	if limit < 1 {
+		limit = 1
+	}
+	if len(runes) <= limit {
+		return line, ""
+	}
+
+	fallback := -1
+	for i := limit; i > 0; i-- {
+		if runes[i] != ' ' {
+			continue
+		}
+
+		if inCode || balancedInline(string(runes[:i])) {
+			return string(runes[:i]), string(runes[i+1:])
+		}
+
+		if fallback == -1 {
+			fallback = i
+		}
+	}
+
+	if fallback != -1 {
+		return string(runes[:fallback]), string(runes[fallback+1:])
+	}
+
+	return string(runes[:limit]), string(runes[limit:])
+}
+
+// balancedInline returns true if text doesn't leave any inline code or
+// formatting open. Single underscores are ignored, as they're commonly used
+// in the middle of words.
+func balancedInline(text string) bool {
+	counts := make(map[string]int)
+
+	for i := 0; i < len(text); i++ {
+		switch c := text[i]; c {
+		case '\\':
+			i++
+		case '`':
+			counts["`"]++
+		case '*', '_', '~', '|':
+			if i+1 < len(text) && text[i+1] == c {
+				counts[text[i:i+2]]++
+				i++
+			} else if c == '*' {
+				counts["*"]++
+			}
+		}
+	}
+
+	for _, count := range counts {
+		if count%2 != 0 {
+			return false
+		}
+	}
+
+	return true
+}
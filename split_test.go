@@ -0,0 +1,180 @@
+package seabird_discord
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestSplitMessage(t *testing.T) {
+	var tests = []struct {
+		Name   string
+		Input  string
+		Limit  int
+		Output []string
+	}{
+		{
+			Name:   "short",
+			Input:  "hello world",
+			Limit:  20,
+			Output: []string{"hello world"},
+		},
+		{
+			Name:   "lines",
+			Input:  "hello\nworld\nfoo bar",
+			Limit:  12,
+			Output: []string{"hello\nworld", "foo bar"},
+		},
+		{
+			Name:   "words",
+			Input:  "hello world foo bar",
+			Limit:  12,
+			Output: []string{"hello world", "foo bar"},
+		},
+		{
+			Name:   "long-word",
+			Input:  "abcdefghij",
+			Limit:  4,
+			Output: []string{"abcd", "efgh", "ij"},
+		},
+		{
+			Name:   "inline-formatting",
+			Input:  "aaa **bold text** bbb",
+			Limit:  14,
+			Output: []string{"aaa", "**bold text**", "bbb"},
+		},
+		{
+			Name:   "inline-code",
+			Input:  "a `code span` b",
+			Limit:  11,
+			Output: []string{"a", "`code span`", "b"},
+		},
+		{
+			Name:  "fenced-code",
+			Input: "intro\n```go\nline 1\nline 2\nline 3\n```\noutro",
+			Limit: 24,
+			Output: []string{
+				"intro\n```go\nline 1\n```",
+				"```go\nline 2\nline 3\n```",
+				"outro",
+			},
+		},
+		{
+			Name:  "nested-fence",
+			Input: "````md\n```go\nline 1\n```\n````",
+			Limit: 24,
+			Output: []string{
+				"````md\n```go\nline 1\n````",
+				"````md\n```\n````",
+			},
+		},
+		{
+			Name:  "fence-then-long-line",
+			Input: "```go\naaaa bbbb cccc\n```",
+			Limit: 16,
+			Output: []string{
+				"```go\naaaa\n```",
+				"```go\nbbbb\n```",
+				"```go\ncccc\n```",
+			},
+		},
+		{
+			Name:  "fence-at-end-of-chunk",
+			Input: "intro\n```go\naaaa bbbb\n```",
+			Limit: 16,
+			Output: []string{
+				"intro",
+				"```go\naaaa\n```",
+				"```go\nbbbb\n```",
+			},
+		},
+		{
+			Name:  "multibyte",
+			Input: "ééé ééé",
+			Limit: 4,
+			Output: []string{
+				"ééé",
+				"ééé",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.Name, func(t *testing.T) {
+			assert.Equal(t, test.Output, splitMessage(test.Input, test.Limit))
+		})
+	}
+}
+
+func TestSplitMessageLimits(t *testing.T) {
+	var lines []string
+	for i := 0; i < 200; i++ {
+		lines = append(lines, strings.Repeat("word ", i%40))
+		if i%25 == 0 {
+			lines = append(lines, "```")
+		}
+	}
+	input := strings.Join(lines, "\n")
+
+	chunks := splitMessage(input, 100)
+	assert.Greater(t, len(chunks), 1)
+
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, utf8.RuneCountInString(chunk), 100)
+		assert.Equal(t, 0, strings.Count(chunk, "```")%2, "unbalanced fence in %q", chunk)
+	}
+}
+
+func TestSplitMessageEmptyCodeBlocks(t *testing.T) {
+	// A code block which starts with a line too long for a chunk shouldn't
+	// leave an empty code block behind.
+	for _, input := range []string{
+		"```go\n" + strings.Repeat("x ", 1200) + "\n```",
+		"````\n" + strings.Repeat("x", 3000),
+		"intro\n```go\n" + strings.Repeat("x ", 1200) + "\n```",
+	} {
+		chunks := splitMessage(input, maxMessageLength)
+		assert.Greater(t, len(chunks), 1)
+		assert.NotEqual(t, "```go\n```", chunks[0])
+		assert.NotEqual(t, "````\n````", chunks[0])
+
+		for _, chunk := range chunks {
+			lines := strings.Split(chunk, "\n")
+			assert.LessOrEqual(t, utf8.RuneCountInString(chunk), maxMessageLength)
+			if fenceMarker(lines[0]) != "" {
+				assert.Greater(t, len(lines), 2, "empty code block in %q", chunk)
+			}
+		}
+	}
+}
+
+func TestMessageChunks(t *testing.T) {
+	assert.Equal(t, []string{"hello world"}, messageChunks("hello world", false))
+	assert.Equal(t, []string{"_waves_"}, messageChunks("waves", true))
+
+	// Code blocks in actions are left alone, as they can't be italicized.
+	assert.Equal(t,
+		[]string{"_runs_\n```go\nfmt.Println()\n```\n_and ```` smiles_"},
+		messageChunks("runs\n```go\nfmt.Println()\n```\nand ```` smiles", true))
+	assert.Equal(t,
+		[]string{"```\ncode\n```"},
+		messageChunks("```\ncode\n```", true))
+
+	// Every chunk of a long action is italicized and fits in a message.
+	var lines []string
+	for i := 0; i < 100; i++ {
+		lines = append(lines, strings.Repeat("word ", 10), "```", "code", "```")
+	}
+
+	chunks := messageChunks(strings.Join(lines, "\n"), true)
+	assert.Greater(t, len(chunks), 1)
+
+	for _, chunk := range chunks {
+		assert.LessOrEqual(t, utf8.RuneCountInString(chunk), maxMessageLength)
+		assert.True(t, strings.HasPrefix(chunk, "_word"), "chunk should start with italics: %q", chunk[:10])
+		assert.NotContains(t, chunk, "_```")
+		assert.NotContains(t, chunk, "```_")
+	}
+}
@@ -0,0 +1,45 @@
+package seabird_discord
+
+// Tags which are added to events sent to seabird-core. The ingest protocol
+// doesn't have a way to represent everything Discord supports, so this is how
+// we pass along the extra information.
+const (
+	// TagMessageID is the ID of the Discord message an event came from.
+	TagMessageID = "discord/message_id"
+
+	// TagEdited is set to "true" when an event comes from an edited message
+	// rather than a new one. The message ID will match the original event.
+	// Edits are only sent if ForwardEdits is enabled, and only as channel
+	// messages and actions, so plugins which count messages should ignore
+	// events with this tag. Edits of commands,
+	// mentions and private messages aren't sent at all, so they don't run a
+	// second time.
+	TagEdited = "discord/edited"
+
+	// TagReplyTo can be set on outgoing messages to the ID of a recent event.
+	// If it came from a message in the same channel, the message will be sent
+	// as a Discord reply to it. If it came from a slash command, the message
+	// will be sent as the response to the command. Channel messages without
+	// this tag are used as the response to the oldest slash command in the
+	// channel which hasn't had one yet.
+	TagReplyTo = "discord/reply_to"
+
+	// TagUsername can be set on outgoing channel messages to send them through
+	// a webhook with this name rather than as the bot user. This is useful for
+	// relaying messages from other networks. Private messages can't be sent
+	// through a webhook, so it is ignored for those.
+	TagUsername = "discord/username"
+
+	// TagAvatarURL sets the avatar of messages sent through a webhook. It is
+	// ignored for messages sent as the bot user.
+	TagAvatarURL = "discord/avatar_url"
+
+	// TagReaction is set to "add" or "remove" on events which come from a
+	// reaction rather than a message. The event text is the emoji, formatted
+	// the same way as in messages, and TagMessageID is the message which was
+	// reacted to.
+	TagReaction = "discord/reaction"
+
+	// TagEmoji is the emoji of a reaction event. It matches the event text.
+	TagEmoji = "discord/emoji"
+)
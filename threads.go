@@ -0,0 +1,184 @@
+package seabird_discord
+
+import (
+	"sync"
+
+	"github.com/bwmarrin/discordgo"
+
+	"github.com/seabird-chat/seabird-go/pb"
+)
+
+// isMessageChannel returns true for any guild channel which can contain
+// messages and should be announced to seabird. Forum channels are skipped
+// because each post is its own thread.
+func isMessageChannel(c *discordgo.Channel) bool {
+	switch c.Type {
+	case discordgo.ChannelTypeGuildText, discordgo.ChannelTypeGuildNews:
+		return true
+	}
+
+	return c.IsThread()
+}
+
+// channelDisplayName returns the name seabird should use for a channel.
+// Threads are named after their parent so they can be told apart.
+func (b *Backend) channelDisplayName(c *discordgo.Channel) string {
+	if !c.IsThread() {
+		return c.Name
+	}
+
+	parent, err := b.session.State().Channel(c.ParentID)
+	if err != nil {
+		return c.Name
+	}
+
+	return parent.Name + "/" + c.Name
+}
+
+func (b *Backend) writeJoinChannel(c *discordgo.Channel) {
+	if !isMessageChannel(c) || !b.listening.IsListening(c.ID) {
+		return
+	}
+
+	if c.IsThread() {
+		b.threads.add(c)
+	}
+
+	b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_JoinChannel{JoinChannel: &pb.JoinChannelChatEvent{
+		ChannelId:   c.ID,
+		DisplayName: b.channelDisplayName(c),
+		Topic:       c.Topic,
+	}}})
+}
+
+func (b *Backend) writeLeaveChannel(channelID string) {
+	b.threads.remove(channelID)
+
+	if !b.listening.IsListening(channelID) {
+		return
+	}
+
+	b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_LeaveChannel{LeaveChannel: &pb.LeaveChannelChatEvent{
+		ChannelId: channelID,
+	}}})
+}
+
+type threadInfo struct {
+	guildID  string
+	parentID string
+}
+
+// threadTracker keeps track of which threads have been announced to seabird.
+// Discord doesn't always tell us when a thread goes away (such as during a
+// thread list sync), so we need to remember them ourselves.
+type threadTracker struct {
+	lock    sync.Mutex
+	threads map[string]threadInfo
+}
+
+func newThreadTracker() *threadTracker {
+	return &threadTracker{
+		threads: make(map[string]threadInfo),
+	}
+}
+
+func (t *threadTracker) add(c *discordgo.Channel) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.threads[c.ID] = threadInfo{guildID: c.GuildID, parentID: c.ParentID}
+}
+
+func (t *threadTracker) has(threadID string) bool {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	_, ok := t.threads[threadID]
+	return ok
+}
+
+func (t *threadTracker) remove(threadID string) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	delete(t.threads, threadID)
+}
+
+// matching returns the IDs of all known threads which match the given filter.
+func (t *threadTracker) matching(filter func(threadInfo) bool) []string {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	var ret []string
+	for id, info := range t.threads {
+		if filter(info) {
+			ret = append(ret, id)
+		}
+	}
+
+	return ret
+}
+
+func (b *Backend) handleThreadCreate(s *discordgo.Session, m *discordgo.ThreadCreate) {
+	b.writeJoinChannel(m.Channel)
+}
+
+// handleThreadUpdate announces changes to a thread. Archived threads are
+// treated as if they had been deleted, and they're joined again if they're
+// unarchived.
+func (b *Backend) handleThreadUpdate(s *discordgo.Session, m *discordgo.ThreadUpdate) {
+	if m.ThreadMetadata != nil && m.ThreadMetadata.Archived {
+		if b.threads.has(m.ID) {
+			b.writeLeaveChannel(m.ID)
+		}
+		return
+	}
+
+	if !b.threads.has(m.ID) {
+		b.writeJoinChannel(m.Channel)
+		return
+	}
+
+	if !b.listening.IsListening(m.ID) {
+		return
+	}
+
+	b.threads.add(m.Channel)
+
+	b.writeEvent(&pb.ChatEvent{Inner: &pb.ChatEvent_ChangeChannel{ChangeChannel: &pb.ChangeChannelChatEvent{
+		ChannelId:   m.ID,
+		DisplayName: b.channelDisplayName(m.Channel),
+		Topic:       m.Topic,
+	}}})
+}
+
+func (b *Backend) handleThreadDelete(s *discordgo.Session, m *discordgo.ThreadDelete) {
+	b.writeLeaveChannel(m.ID)
+}
+
+func (b *Backend) handleThreadListSync(s *discordgo.Session, m *discordgo.ThreadListSync) {
+	synced := make(map[string]bool)
+	for _, channelID := range m.ChannelIDs {
+		synced[channelID] = true
+	}
+
+	active := make(map[string]bool)
+	for _, thread := range m.Threads {
+		active[thread.ID] = true
+	}
+
+	// Any threads we know about which are covered by this sync but aren't
+	// included are no longer active.
+	stale := b.threads.matching(func(info threadInfo) bool {
+		return info.guildID == m.GuildID && (len(synced) == 0 || synced[info.parentID])
+	})
+	for _, threadID := range stale {
+		if !active[threadID] {
+			b.writeLeaveChannel(threadID)
+		}
+	}
+
+	for _, thread := range m.Threads {
+		b.writeJoinChannel(thread)
+	}
+}
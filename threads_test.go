@@ -0,0 +1,104 @@
+package seabird_discord
+
+import (
+	"sort"
+	"testing"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIsMessageChannel(t *testing.T) {
+	for channelType, expected := range map[discordgo.ChannelType]bool{
+		discordgo.ChannelTypeGuildText:          true,
+		discordgo.ChannelTypeGuildNews:          true,
+		discordgo.ChannelTypeGuildPublicThread:  true,
+		discordgo.ChannelTypeGuildPrivateThread: true,
+		discordgo.ChannelTypeGuildNewsThread:    true,
+		discordgo.ChannelTypeGuildForum:         false,
+		discordgo.ChannelTypeGuildVoice:         false,
+		discordgo.ChannelTypeDM:                 false,
+	} {
+		assert.Equal(t, expected, isMessageChannel(&discordgo.Channel{Type: channelType}), "channel type %d", channelType)
+	}
+}
+
+func TestThreadTracker(t *testing.T) {
+	tracker := newThreadTracker()
+
+	tracker.add(&discordgo.Channel{ID: "a", GuildID: "g1", ParentID: "p1"})
+	tracker.add(&discordgo.Channel{ID: "b", GuildID: "g1", ParentID: "p2"})
+	tracker.add(&discordgo.Channel{ID: "c", GuildID: "g2", ParentID: "p3"})
+
+	inGuild := tracker.matching(func(info threadInfo) bool { return info.guildID == "g1" })
+	sort.Strings(inGuild)
+	assert.Equal(t, []string{"a", "b"}, inGuild)
+
+	tracker.remove("a")
+
+	inParent := tracker.matching(func(info threadInfo) bool { return info.parentID == "p1" })
+	assert.Empty(t, inParent)
+}
+
+func TestBackendThreadEvents(t *testing.T) {
+	b, fake := newTestBackend(t, DefaultConfig())
+
+	require.NoError(t, fake.Dispatch("GUILD_CREATE", testGuild))
+	assert.Equal(t, "10", nextChannelEvent(t, b).GetJoinChannel().GetChannelId())
+
+	thread := &discordgo.Channel{
+		ID:             "12",
+		GuildID:        "1",
+		ParentID:       "10",
+		Name:           "plans",
+		Type:           discordgo.ChannelTypeGuildPublicThread,
+		ThreadMetadata: &discordgo.ThreadMetadata{},
+	}
+
+	require.NoError(t, fake.Dispatch("THREAD_CREATE", thread))
+
+	join := nextChannelEvent(t, b).GetJoinChannel()
+	require.NotNil(t, join)
+	assert.Equal(t, "12", join.ChannelId)
+	assert.Equal(t, "general/plans", join.DisplayName)
+	assert.True(t, b.threads.has("12"))
+
+	renamed := *thread
+	renamed.Name = "new plans"
+	require.NoError(t, fake.Dispatch("THREAD_UPDATE", &renamed))
+
+	change := nextChannelEvent(t, b).GetChangeChannel()
+	require.NotNil(t, change)
+	assert.Equal(t, "12", change.ChannelId)
+	assert.Equal(t, "general/new plans", change.DisplayName)
+
+	// Archiving a thread leaves it, and unarchiving it joins it again.
+	archived := renamed
+	archived.ThreadMetadata = &discordgo.ThreadMetadata{Archived: true}
+	require.NoError(t, fake.Dispatch("THREAD_UPDATE", &archived))
+
+	leave := nextChannelEvent(t, b).GetLeaveChannel()
+	require.NotNil(t, leave)
+	assert.Equal(t, "12", leave.ChannelId)
+	assert.False(t, b.threads.has("12"))
+
+	require.NoError(t, fake.Dispatch("THREAD_UPDATE", &renamed))
+
+	join = nextChannelEvent(t, b).GetJoinChannel()
+	require.NotNil(t, join)
+	assert.Equal(t, "12", join.ChannelId)
+	assert.True(t, b.threads.has("12"))
+
+	require.NoError(t, fake.Dispatch("THREAD_DELETE", &discordgo.Channel{
+		ID:       "12",
+		GuildID:  "1",
+		ParentID: "10",
+		Type:     discordgo.ChannelTypeGuildPublicThread,
+	}))
+
+	leave = nextChannelEvent(t, b).GetLeaveChannel()
+	require.NotNil(t, leave)
+	assert.Equal(t, "12", leave.ChannelId)
+	assert.False(t, b.threads.has("12"))
+}
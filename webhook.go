@@ -0,0 +1,213 @@
+package seabird_discord
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// webhookName is the name of webhooks created by the backend. Any existing
+// webhook with this name which was created by the bot is reused.
+const webhookName = "seabird"
+
+// maxWebhookUsernameLength is the longest username Discord allows when
+// executing a webhook.
+const maxWebhookUsernameLength = 80
+
+// channelWebhook returns the managed webhook for a channel, finding or
+// creating it if needed.
+func (b *Backend) channelWebhook(channelID string) (*discordgo.Webhook, error) {
+	if webhook, ok := b.cachedWebhook(channelID); ok {
+		return webhook, nil
+	}
+
+	// Only one lookup runs for a channel at a time, so two workers don't both
+	// create a webhook for it. Anything else waiting gets the same result.
+	ret, err, _ := b.webhookLookups.Do(channelID, func() (interface{}, error) {
+		// Another lookup may have finished since we checked the cache.
+		if webhook, ok := b.cachedWebhook(channelID); ok {
+			return webhook, nil
+		}
+
+		webhook, err := b.findOrCreateWebhook(channelID)
+		if err != nil {
+			return nil, err
+		}
+
+		b.webhooksLock.Lock()
+		b.webhooks[channelID] = webhook
+		b.webhookOwners[webhook.ID] = true
+		b.webhooksLock.Unlock()
+
+		return webhook, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return ret.(*discordgo.Webhook), nil
+}
+
+func (b *Backend) cachedWebhook(channelID string) (*discordgo.Webhook, bool) {
+	b.webhooksLock.Lock()
+	defer b.webhooksLock.Unlock()
+
+	webhook, ok := b.webhooks[channelID]
+	return webhook, ok
+}
+
+// findOrCreateWebhook reuses a managed webhook which already exists in a
+// channel, or creates a new one.
+func (b *Backend) findOrCreateWebhook(channelID string) (*discordgo.Webhook, error) {
+	webhooks, err := b.session.ChannelWebhooks(channelID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list webhooks: %w", err)
+	}
+
+	botUserID := b.session.BotUserID()
+
+	for _, w := range webhooks {
+		// Webhooks created by someone else don't include a token, so we can't
+		// use them.
+		if isManagedWebhook(w, botUserID) && w.Token != "" {
+			return w, nil
+		}
+	}
+
+	webhook, err := b.session.WebhookCreate(channelID, webhookName, "")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create webhook: %w", err)
+	}
+
+	b.logger.Info().Str("channel_id", channelID).Msg("Created webhook")
+
+	return webhook, nil
+}
+
+// isManagedWebhook returns true if a webhook was created by the backend,
+// either by this process or before a restart.
+func isManagedWebhook(webhook *discordgo.Webhook, botUserID string) bool {
+	return webhook.Name == webhookName && webhook.User != nil && webhook.User.ID == botUserID
+}
+
+// forgetWebhook removes a webhook from the cache if it's still the one stored
+// for the channel.
+func (b *Backend) forgetWebhook(channelID string, webhook *discordgo.Webhook) {
+	b.webhooksLock.Lock()
+	defer b.webhooksLock.Unlock()
+
+	if b.webhooks[channelID] == webhook {
+		delete(b.webhooks, channelID)
+	}
+}
+
+// isOwnWebhook returns true if a webhook is one we send messages through. Any
+// webhook we haven't seen before is looked up, as it may be one we created
+// before a restart.
+func (b *Backend) isOwnWebhook(webhookID string) bool {
+	if webhookID == "" {
+		return false
+	}
+
+	b.webhooksLock.Lock()
+	own, ok := b.webhookOwners[webhookID]
+	b.webhooksLock.Unlock()
+
+	if ok {
+		return own
+	}
+
+	webhook, err := b.session.Webhook(webhookID)
+	if err != nil {
+		// If Discord answered, we won't be able to see the webhook next time
+		// either, so it's remembered as someone else's. Otherwise we try again
+		// with the next message.
+		var restErr *discordgo.RESTError
+		if errors.As(err, &restErr) {
+			b.setWebhookOwner(webhookID, false)
+		}
+
+		b.logger.Warn().Err(err).Str("webhook_id", webhookID).Msg("failed to look up webhook")
+		return false
+	}
+
+	own = isManagedWebhook(webhook, b.session.BotUserID())
+	b.setWebhookOwner(webhookID, own)
+
+	return own
+}
+
+func (b *Backend) setWebhookOwner(webhookID string, own bool) {
+	b.webhooksLock.Lock()
+	defer b.webhooksLock.Unlock()
+
+	b.webhookOwners[webhookID] = own
+}
+
+// sendWebhookMessage sends a message to a channel through its managed
+// webhook, using the identity from the tags. Webhooks can't send replies, so
+// TagReplyTo is ignored.
+func (b *Backend) sendWebhookMessage(channelID string, content string, tags map[string]string) error {
+	// Threads don't have their own webhooks, so we use the parent channel's
+	// and send to the thread through it.
+	webhookChannelID, threadID := channelID, ""
+	if c, err := b.session.State().Channel(channelID); err == nil && c.IsThread() {
+		webhookChannelID, threadID = c.ParentID, channelID
+	}
+
+	params := &discordgo.WebhookParams{
+		Content:   content,
+		Username:  truncateRunes(tags[TagUsername], maxWebhookUsernameLength),
+		AvatarURL: tags[TagAvatarURL],
+		Flags:     discordgo.MessageFlagsSuppressEmbeds,
+	}
+
+	// If the webhook was deleted since we last used it, we need to make a new
+	// one, but that should only need to happen once.
+	for attempt := 0; ; attempt++ {
+		webhook, err := b.channelWebhook(webhookChannelID)
+		if err != nil {
+			return err
+		}
+
+		if threadID != "" {
+			_, err = b.session.WebhookThreadExecute(webhook.ID, webhook.Token, true, threadID, params)
+		} else {
+			_, err = b.session.WebhookExecute(webhook.ID, webhook.Token, true, params)
+		}
+
+		if attempt == 0 && isUnknownWebhook(err) {
+			b.logger.Info().Str("channel_id", webhookChannelID).Msg("Webhook was deleted, recreating it")
+			b.forgetWebhook(webhookChannelID, webhook)
+			continue
+		}
+
+		return err
+	}
+}
+
+// isUnknownWebhook returns true if an error means a webhook no longer exists.
+func isUnknownWebhook(err error) bool {
+	var restErr *discordgo.RESTError
+	if !errors.As(err, &restErr) {
+		return false
+	}
+
+	if restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownWebhook {
+		return true
+	}
+
+	return restErr.Response != nil && restErr.Response.StatusCode == http.StatusNotFound
+}
+
+// truncateRunes shortens a string to at most n runes.
+func truncateRunes(s string, n int) string {
+	runes := []rune(s)
+	if len(runes) <= n {
+		return s
+	}
+
+	return string(runes[:n])
+}